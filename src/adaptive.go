@@ -0,0 +1,445 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// numThompsonDraws is the number of posterior draws used to estimate
+// the probability that each group is the best.
+const numThompsonDraws = 1000
+
+// thompsonSampling assigns each subject to a group with probability
+// equal to the posterior probability that the group has the best
+// outcome (Thompson, Biometrika 25, 1933).  Binary outcomes have
+// independent uniform priors on the success probabilities.  The
+// means of continuous outcomes have flat priors, and the posteriors
+// are approximated as normal.
+type thompsonSampling struct{}
+
+func (thompsonSampling) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	if inBurnIn(project) {
+		return sampleIndex(project.SamplingRates, rgen), nil
+	}
+
+	probs := thompsonProbs(project, rgen)
+
+	return sampleIndex(capProbs(probs, project.MinProb, project.MaxProb), rgen), nil
+}
+
+func (thompsonSampling) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	if inBurnIn(project) {
+		return rateProbs(project), nil
+	}
+
+	// The generator has the same seed as the one used by Assign, so
+	// these are the probabilities that Assign samples from.
+	probs := thompsonProbs(project, rgen)
+
+	return capProbs(probs, project.MinProb, project.MaxProb), nil
+}
+
+// playTheWinner implements the randomized play-the-winner urn of Wei
+// and Durham (JASA 73, 1978), for binary outcomes.  The urn initially
+// contains one ball for each group.  Each success adds a ball for the
+// subject's group, and each failure adds one ball that is shared
+// among the other groups.  The subjects are assigned with
+// probabilities proportional to the numbers of balls.
+type playTheWinner struct{}
+
+func (playTheWinner) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	if inBurnIn(project) {
+		return sampleIndex(project.SamplingRates, rgen), nil
+	}
+
+	return sampleIndex(capProbs(urnProbs(project), project.MinProb, project.MaxProb), rgen), nil
+}
+
+func (playTheWinner) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	if inBurnIn(project) {
+		return rateProbs(project), nil
+	}
+
+	return capProbs(urnProbs(project), project.MinProb, project.MaxProb), nil
+}
+
+// inBurnIn returns true if fewer than project.BurnIn subjects have
+// been assigned.  During the burn-in period the subjects are assigned
+// with probabilities proportional to the sampling rates.
+func inBurnIn(project *Project) bool {
+
+	n := 0
+	for _, x := range project.Assignments {
+		n += x
+	}
+	return n < project.BurnIn
+}
+
+// updateOutcomeStats adds an outcome y of a subject in group grp to
+// (d=1), or removes it from (d=-1), the outcome aggregates.  The three
+// rows of OutcomeStats contain the number of outcomes, their sum and
+// their sum of squares within each group.
+func updateOutcomeStats(project *Project, grp int, y float64, d float64) {
+
+	if project.OutcomeStats == nil {
+		return
+	}
+	project.OutcomeStats[0][grp] += d
+	project.OutcomeStats[1][grp] += d * y
+	project.OutcomeStats[2][grp] += d * y * y
+}
+
+// newOutcomeStats returns empty outcome aggregates for the project.
+func newOutcomeStats(project *Project) [][]float64 {
+
+	stats := make([][]float64, 3)
+	for k := range stats {
+		stats[k] = make([]float64, len(project.GroupNames))
+	}
+	return stats
+}
+
+// thompsonProbs estimates the posterior probability that each group
+// has the best outcome, using posterior draws from rgen.
+func thompsonProbs(project *Project, rgen *rand.Rand) []float64 {
+
+	numGroups := len(project.GroupNames)
+	stats := project.OutcomeStats
+	probs := make([]float64, numGroups)
+
+	// For continuous outcomes, groups with fewer than two outcomes
+	// use the mean and standard deviation of all outcomes.
+	_, sds, mean, sd := groupMoments(stats)
+	if project.OutcomeType == "Continuous" && (math.IsNaN(sd) || sd == 0) {
+		for i := range probs {
+			probs[i] = 1 / float64(numGroups)
+		}
+		return probs
+	}
+
+	draws := make([]float64, numGroups)
+	for r := 0; r < numThompsonDraws; r++ {
+		for i := 0; i < numGroups; i++ {
+			n, sum := stats[0][i], stats[1][i]
+			if project.OutcomeType == "Continuous" {
+				if n < 2 || sds[i] == 0 {
+					draws[i] = mean + sd*rgen.NormFloat64()
+				} else {
+					draws[i] = sum/n + sds[i]/math.Sqrt(n)*rgen.NormFloat64()
+				}
+			} else {
+				draws[i] = betaRand(1+sum, 1+n-sum, rgen)
+			}
+			if project.SmallerBetter {
+				draws[i] = -draws[i]
+			}
+		}
+
+		best := 0
+		for i, x := range draws {
+			if x > draws[best] {
+				best = i
+			}
+		}
+		probs[best]++
+	}
+
+	for i := range probs {
+		probs[i] /= numThompsonDraws
+	}
+
+	return probs
+}
+
+// urnProbs returns the probabilities of drawing a ball for each group
+// from the randomized play-the-winner urn.  If smaller outcomes are
+// better, an outcome of zero counts as a success.
+func urnProbs(project *Project) []float64 {
+
+	numGroups := len(project.GroupNames)
+	stats := project.OutcomeStats
+
+	balls := make([]float64, numGroups)
+	for i := range balls {
+		balls[i] = 1
+	}
+	for i := 0; i < numGroups; i++ {
+		success, failure := stats[1][i], stats[0][i]-stats[1][i]
+		if project.SmallerBetter {
+			success, failure = failure, success
+		}
+		balls[i] += success
+		for j := range balls {
+			if j != i {
+				balls[j] += failure / float64(numGroups-1)
+			}
+		}
+	}
+
+	tot := 0.0
+	for _, x := range balls {
+		tot += x
+	}
+	for i := range balls {
+		balls[i] /= tot
+	}
+
+	return balls
+}
+
+// capProbs restricts the assignment probabilities to the range
+// [lo, hi], and redistributes the excess or shortfall among the other
+// groups in proportion to their probabilities.  A zero hi means that
+// there is no upper limit.
+func capProbs(probs []float64, lo, hi float64) []float64 {
+
+	if hi <= 0 {
+		hi = 1
+	}
+
+	p := make([]float64, len(probs))
+	copy(p, probs)
+	fixed := make([]bool, len(p))
+
+	// Each pass rescales the probabilities that are not yet fixed,
+	// and fixes the one that is furthest outside the limits, so
+	// this terminates after at most len(p) passes.
+	for pass := 0; pass < len(p); pass++ {
+		free, rest, nfree := 0.0, 1.0, 0
+		for i, x := range p {
+			if fixed[i] {
+				rest -= x
+			} else {
+				free += x
+				nfree++
+			}
+		}
+
+		worst, excess := -1, 0.0
+		for i, x := range p {
+			if fixed[i] {
+				continue
+			}
+			if free > 0 {
+				p[i] = x * rest / free
+			} else {
+				p[i] = rest / float64(nfree)
+			}
+			if d := math.Max(lo-p[i], p[i]-hi); d > excess {
+				worst, excess = i, d
+			}
+		}
+		if worst == -1 {
+			break
+		}
+
+		fixed[worst] = true
+		p[worst] = math.Max(lo, math.Min(hi, p[worst]))
+	}
+
+	return p
+}
+
+// betaRand returns a draw from the beta distribution with parameters
+// a and b.
+func betaRand(a, b float64, rgen *rand.Rand) float64 {
+
+	x := gammaRand(a, rgen)
+	y := gammaRand(b, rgen)
+	return x / (x + y)
+}
+
+// gammaRand returns a draw from the gamma distribution with shape a
+// (at least one) and unit scale, using the method of Marsaglia and
+// Tsang (ACM TOMS 26, 2000).
+func gammaRand(a float64, rgen *rand.Rand) float64 {
+
+	d := a - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rgen.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rgen.Float64()
+		if math.Log(u) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// parseOutcome converts an outcome to a number, checking that binary
+// outcomes are zero or one.
+func parseOutcome(s string, outcomeType string) (float64, error) {
+
+	y, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0, fmt.Errorf("The outcome '%s' is not a number.", s)
+	}
+	if outcomeType == "Binary" && y != 0 && y != 1 {
+		return 0, fmt.Errorf("A binary outcome must be 0 or 1.")
+	}
+
+	return y, nil
+}
+
+// recordOutcome displays a form for entering the outcome of a subject.
+func recordOutcome(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	proj, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "recordOutcome: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if proj.OutcomeType == "" {
+		msg := "Outcomes are not recorded for this project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// The subjects that are waiting for an outcome.
+	var pending []string
+	for _, rec := range proj.RawData {
+		if rec.Included && !rec.HasOutcome {
+			pending = append(pending, rec.SubjectId)
+		}
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		OutcomeType string
+		Pending     []string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		Pkey:        pkey,
+		ProjectName: proj.Name,
+		OutcomeType: proj.OutcomeType,
+		Pending:     pending,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "record_outcome.html", tvals); err != nil {
+		log.Errorf(ctx, "recordOutcome failed to execute template: %v", err)
+	}
+}
+
+// recordOutcomeConfirm stores the outcome of a subject.
+func recordOutcomeConfirm(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	proj, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "recordOutcomeConfirm: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectId := strings.TrimSpace(r.FormValue("subject_id"))
+	y, err := parseOutcome(r.FormValue("outcome"), proj.OutcomeType)
+	if err != nil {
+		msg := fmt.Sprintf("The outcome was not recorded.  %v", err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var rec *DataRecord
+	for _, x := range proj.RawData {
+		if x.SubjectId == subjectId {
+			rec = x
+		}
+	}
+
+	// Outcomes cannot be changed once recorded, since they may
+	// have been used to assign later subjects.
+	switch {
+	case rec == nil:
+		msg := fmt.Sprintf("There is no subject with id '%s' in the project.", subjectId)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	case !rec.Included:
+		msg := fmt.Sprintf("Subject '%s' has been removed from the project.", subjectId)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	case rec.HasOutcome:
+		msg := fmt.Sprintf("An outcome has already been recorded for subject '%s'.", subjectId)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	rec.HasOutcome = true
+	rec.Outcome = y
+	rec.OutcomeTime = time.Now()
+	updateOutcomeStats(proj, getIndex(proj.GroupNames, rec.CurrentGroup), y, 1)
+
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{fmt.Sprintf("Outcome %v recorded for subject '%s'.", y, subjectId)}
+	proj.Comments = append(proj.Comments, comment)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Errorf(ctx, "recordOutcomeConfirm: %v", err)
+		msg := "Datastore error: unable to save project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The outcome of subject '%s' has been recorded.", subjectId)
+	rmsg := "Return to project dashboard"
+	messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
@@ -0,0 +1,172 @@
+package randomization
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Allocator selects the treatment group for a newly enrolled subject.
+// M maps the variable names to the subject's values, and site is the
+// subject's site (blank if the project has no sites).  The returned
+// value is the position of the selected group within
+// project.GroupNames.  An Allocator may update its own state in the
+// project (e.g. the position within a permuted block), but should not
+// update the aggregate data, this is done by doAssignment once the
+// group has been selected.
+type Allocator interface {
+	Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error)
+}
+
+// ProbabilityAllocator is implemented by the allocators that can
+// report the probability with which each group would be selected for
+// the subject.  Probabilities is called before Assign, with a random
+// number generator that has the same seed as the one passed to
+// Assign, and must not change the project.
+type ProbabilityAllocator interface {
+	Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error)
+}
+
+// AllocationMethod describes one of the allocation methods that can be
+// selected when a project is created.
+type AllocationMethod struct {
+	// The name that is stored with the project
+	Name string
+
+	// A human-readable description of the method
+	Label string
+
+	Allocator Allocator
+}
+
+// allocationMethods contains all available allocation methods, in the
+// order that they are offered during project creation.
+var allocationMethods = []*AllocationMethod{
+	{
+		Name:      "Minimization",
+		Label:     "Pocock-Simon minimization",
+		Allocator: minimization{},
+	},
+	{
+		Name:      "Simple",
+		Label:     "Simple randomization",
+		Allocator: simpleRandomization{},
+	},
+	{
+		Name:      "Blocks",
+		Label:     "Permuted blocks",
+		Allocator: permutedBlocks{},
+	},
+	{
+		Name:      "StratifiedBlocks",
+		Label:     "Stratified permuted blocks",
+		Allocator: stratifiedBlocks{},
+	},
+	{
+		Name:      "BiasedCoin",
+		Label:     "Efron's biased coin (two groups)",
+		Allocator: biasedCoin{},
+	},
+	{
+		Name:      "BigStick",
+		Label:     "Big stick design (two groups)",
+		Allocator: bigStick{},
+	},
+	{
+		Name:      "List",
+		Label:     "Pre-generated randomization list",
+		Allocator: randomizationList{},
+	},
+	{
+		Name:      "Thompson",
+		Label:     "Response-adaptive: Thompson sampling",
+		Allocator: thompsonSampling{},
+	},
+	{
+		Name:      "PlayTheWinner",
+		Label:     "Response-adaptive: randomized play-the-winner (binary outcome)",
+		Allocator: playTheWinner{},
+	},
+	{
+		Name:      "Cluster",
+		Label:     "Cluster randomization (constrained allocation)",
+		Allocator: clusterAllocation{},
+	},
+}
+
+// defaultMethod is the allocation method for projects that were created
+// before the allocation method could be selected.
+const defaultMethod = "Minimization"
+
+// getAllocationMethod returns the allocation method with the given
+// name.
+func getAllocationMethod(name string) (*AllocationMethod, error) {
+
+	for _, am := range allocationMethods {
+		if am.Name == name {
+			return am, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown allocation method '%s'", name)
+}
+
+// getAllocator returns the Allocator for the allocation method with
+// the given name.
+func getAllocator(name string) (Allocator, error) {
+
+	am, err := getAllocationMethod(name)
+	if err != nil {
+		return nil, err
+	}
+	return am.Allocator, nil
+}
+
+// sampleIndex returns a random position in wts, selected with
+// probability proportional to the weights.
+func sampleIndex(wts []float64, rgen *rand.Rand) int {
+
+	tot := 0.0
+	for _, w := range wts {
+		tot += w
+	}
+
+	u := tot * rgen.Float64()
+	for i, w := range wts {
+		if u < w {
+			return i
+		}
+		u -= w
+	}
+	return len(wts) - 1
+}
+
+// simpleRandomization assigns each subject independently of all
+// previous assignments, with the group probabilities proportional to
+// the sampling rates.
+type simpleRandomization struct{}
+
+func (simpleRandomization) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	return sampleIndex(project.SamplingRates, rgen), nil
+}
+
+func (simpleRandomization) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	return rateProbs(project), nil
+}
+
+// rateProbs returns the probabilities of the groups when the subjects
+// are assigned in proportion to the sampling rates.
+func rateProbs(project *Project) []float64 {
+
+	tot := 0.0
+	for _, x := range project.SamplingRates {
+		tot += x
+	}
+
+	probs := make([]float64, len(project.SamplingRates))
+	for i, x := range project.SamplingRates {
+		probs[i] = x / tot
+	}
+
+	return probs
+}
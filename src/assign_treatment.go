@@ -7,7 +7,6 @@ import (
 	"time"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -60,6 +59,8 @@ func assignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 		NumGroups int
 		Fields    string
 		Pkey      string
+		AnySites  bool
+		Site      string
 	}{
 		User:      user.String(),
 		LoggedIn:  user != nil,
@@ -67,6 +68,8 @@ func assignTreatmentInput(w http.ResponseWriter, r *http.Request) {
 		PV:        PV,
 		NumGroups: len(PR.GroupNames),
 		Pkey:      pkey,
+		AnySites:  len(PR.Sites) > 0,
+		Site:      PR.UserSites[strings.ToLower(user.String())],
 	}
 
 	S := make([]string, len(PR.Variables))
@@ -157,11 +160,52 @@ func assignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 	FV := make([][]string, len(Fields)+1)
 	Values := make([]string, len(Fields))
 
+	site := r.FormValue("site")
+
 	FV[0] = []string{"Subject id", subjectId}
+	mpv := make(map[string]string)
 	for i, v := range Fields {
-		x := r.FormValue(v)
+		x := strings.TrimSpace(r.FormValue(v))
+		if project.Method == "Cluster" {
+			// The subjects have the values of their cluster.
+			x = ""
+			if values := project.ClusterValues[site]; i < len(values) {
+				x = values[i]
+			}
+		}
 		FV[i+1] = []string{v, x}
+		if x == "" {
+			FV[i+1][1] = "(missing)"
+		}
 		Values[i] = x
+		mpv[v] = x
+	}
+
+	if len(project.Sites) > 0 {
+		if getIndex(project.Sites, site) == -1 {
+			msg := "Please select the site at which the subject is enrolled."
+			rmsg := "Return to project"
+			messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+		FV = append(FV, []string{"Site", site})
+	}
+
+	if project.Method == "Cluster" {
+		if _, ok := project.ClusterGroups[site]; !ok {
+			msg := fmt.Sprintf("The cluster '%s' has not been randomized yet.", site)
+			rmsg := "Return to project"
+			messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+		FV[len(FV)-1][0] = "Cluster"
+	}
+
+	if err := checkSubjectData(&mpv, project); err != nil {
+		msg := fmt.Sprintf("%v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
 	}
 
 	tvals := struct {
@@ -175,6 +219,7 @@ func assignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 		FV          [][]string
 		Values      string
 		SubjectId   string
+		Site        string
 		AnyVars     bool
 	}{
 		User:        user.String(),
@@ -187,7 +232,8 @@ func assignTreatmentConfirm(w http.ResponseWriter, r *http.Request) {
 		FV:          FV,
 		Values:      strings.Join(Values, ","),
 		SubjectId:   subjectId,
-		AnyVars:     len(project.Variables) > 0,
+		Site:        site,
+		AnyVars:     len(project.Variables) > 0 || len(project.Sites) > 0,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "assign_treatment_confirm.html", tvals); err != nil {
@@ -247,17 +293,19 @@ func assignTreatment(w http.ResponseWriter, r *http.Request) {
 		mpv[x] = values[i]
 	}
 
-	ax, err := doAssignment(&mpv, proj, subjectId, user.String())
+	ax, err := doAssignment(&mpv, r.FormValue("site"), proj, subjectId, user.String())
 	if err != nil {
 		log.Errorf(ctx, "%v", err)
+		msg := fmt.Sprintf("The subject was not assigned to a treatment group: %v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
 	}
 
 	proj.Modified = time.Now()
 
 	// Update the project in the database.
-	eproj, _ := encodeProject(proj)
-	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	_, err = datastore.Put(ctx, key, eproj)
+	err = storeProject(ctx, proj, pkey)
 	if err != nil {
 		log.Errorf(ctx, "Assign_treatment: %v", err)
 		msg := "A datastore error occured, the project could not be updated."
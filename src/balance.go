@@ -0,0 +1,691 @@
+package randomization
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// BalanceDiagnostic contains the formal balance diagnostics of one
+// variable across the treatment groups.  Values that cannot be
+// calculated, for example because a group has no subjects, are nil.
+type BalanceDiagnostic struct {
+	Variable string
+	Type     string
+
+	// The scoring function of the variable, and the current
+	// imbalance under it.  The imbalance of a variable scored with
+	// "IsMin" is not defined, since that function only compares the
+	// groups before an assignment.
+	Func      string
+	Weight    float64
+	Imbalance *float64
+
+	// The test of association between the variable and the
+	// treatment groups, which is the chi-square test or, for a two
+	// by two table with small expected counts, Fisher's exact test
+	// for categorical variables, and the one-way analysis of
+	// variance F test for continuous variables.  DF contains the
+	// degrees of freedom of the statistic.
+	Test      string
+	Statistic *float64
+	DF        []int
+	PValue    *float64
+
+	// The largest absolute standardized difference between two
+	// groups, over the levels of a categorical variable.
+	MaxStdDiff *float64
+
+	// The diagnostics of each level of a categorical variable,
+	// including the missing values if they are allowed.
+	Levels []*LevelDiagnostic
+
+	// The number of subjects, mean and standard deviation of a
+	// continuous variable within each group.
+	N     []int
+	Means []*float64
+	SDs   []*float64
+}
+
+// LevelDiagnostic contains the balance diagnostics of one level of a
+// categorical variable.
+type LevelDiagnostic struct {
+	Level  string
+	Counts []int
+
+	// The percentage of the subjects of each group who have this
+	// level, and the percentage of the subjects with this level who
+	// are in each group.
+	GroupPercents []*float64
+	LevelPercents []*float64
+
+	// The largest absolute standardized difference between two
+	// groups in the proportion of subjects with this level.
+	StdDiff *float64
+}
+
+// optionalValue returns a pointer to x, or nil if x is not finite.
+func optionalValue(x float64) *float64 {
+
+	if math.IsNaN(x) || math.IsInf(x, 0) {
+		return nil
+	}
+	return &x
+}
+
+// formatOptional formats an optional value, using "-" for a missing
+// value.
+func formatOptional(format string, x *float64) string {
+
+	if x == nil {
+		return "-"
+	}
+	return fmt.Sprintf(format, *x)
+}
+
+// balanceDiagnostics returns the balance diagnostics of each variable
+// of the project, using all subjects who are currently included.
+func balanceDiagnostics(project *Project) []*BalanceDiagnostic {
+
+	var diags []*BalanceDiagnostic
+	for j, va := range project.Variables {
+		if va.Type == "Continuous" {
+			diags = append(diags, continuousDiagnostic(&va, project.Data[j]))
+		} else {
+			diags = append(diags, categoricalDiagnostic(&va, project.Data[j], project))
+		}
+	}
+
+	return diags
+}
+
+// categoricalDiagnostic returns the balance diagnostics of a
+// categorical variable with the given aggregate data.
+func categoricalDiagnostic(va *Variable, data [][]float64, project *Project) *BalanceDiagnostic {
+
+	numGroups := len(project.GroupNames)
+	bd := &BalanceDiagnostic{
+		Variable: va.Name,
+		Type:     va.Type,
+		Func:     va.Func,
+		Weight:   va.Weight,
+	}
+	if bd.Type == "" {
+		bd.Type = "Categorical"
+	}
+
+	// The table of counts, with an additional row for the missing
+	// values if they are allowed.
+	var levels []string
+	var table [][]float64
+	missing := make([]float64, numGroups)
+	for i, n := range project.Assignments {
+		missing[i] = float64(n)
+	}
+	for k, x := range va.Levels {
+		levels = append(levels, x)
+		table = append(table, data[k])
+		for i := range missing {
+			missing[i] -= data[k][i]
+		}
+	}
+	if va.AllowMissing {
+		levels = append(levels, "(missing)")
+		table = append(table, missing)
+	}
+
+	bd.Imbalance = optionalValue(variableImbalance(va, data, project.SamplingRates))
+
+	colTotals := make([]float64, numGroups)
+	for _, row := range table {
+		for i, n := range row {
+			colTotals[i] += n
+		}
+	}
+
+	maxDiff := math.NaN()
+	for k, row := range table {
+		ld := &LevelDiagnostic{
+			Level:         levels[k],
+			Counts:        make([]int, numGroups),
+			GroupPercents: make([]*float64, numGroups),
+			LevelPercents: make([]*float64, numGroups),
+		}
+		rowTotal := 0.0
+		for _, n := range row {
+			rowTotal += n
+		}
+		props := make([]float64, numGroups)
+		for i, n := range row {
+			ld.Counts[i] = int(n)
+			props[i] = n / colTotals[i]
+			ld.GroupPercents[i] = optionalValue(100 * props[i])
+			ld.LevelPercents[i] = optionalValue(100 * n / rowTotal)
+		}
+		d := maxStdDiff(props, nil)
+		ld.StdDiff = optionalValue(d)
+		if !math.IsNaN(d) && !(d <= maxDiff) {
+			maxDiff = d
+		}
+		bd.Levels = append(bd.Levels, ld)
+	}
+	bd.MaxStdDiff = optionalValue(maxDiff)
+
+	contingencyTest(bd, table)
+
+	return bd
+}
+
+// continuousDiagnostic returns the balance diagnostics of a continuous
+// variable with the given aggregate data.
+func continuousDiagnostic(va *Variable, data [][]float64) *BalanceDiagnostic {
+
+	numGroups := len(data[0])
+	bd := &BalanceDiagnostic{
+		Variable: va.Name,
+		Type:     va.Type,
+		Func:     va.Func,
+		Weight:   va.Weight,
+		N:        make([]int, numGroups),
+		Means:    make([]*float64, numGroups),
+		SDs:      make([]*float64, numGroups),
+	}
+
+	means, sds, mean, _ := groupMoments(data)
+	for i := range means {
+		bd.N[i] = int(data[0][i])
+		bd.Means[i] = optionalValue(means[i])
+		bd.SDs[i] = optionalValue(sds[i])
+	}
+	bd.MaxStdDiff = optionalValue(maxStdDiff(means, sds))
+	bd.Imbalance = optionalValue(variableImbalance(va, data, nil))
+
+	// One-way analysis of variance
+	var n, ssb, ssw float64
+	k := 0
+	for i := range means {
+		if data[0][i] == 0 {
+			continue
+		}
+		k++
+		n += data[0][i]
+		d := means[i] - mean
+		ssb += data[0][i] * d * d
+		ssw += data[2][i] - data[0][i]*means[i]*means[i]
+	}
+	if k < 2 || n-float64(k) < 1 {
+		return bd
+	}
+	df1, df2 := float64(k-1), n-float64(k)
+	bd.Test = "F"
+	bd.DF = []int{k - 1, int(df2)}
+	if !(ssw > 0) {
+		if ssb > 0 {
+			bd.PValue = optionalValue(0)
+		}
+		return bd
+	}
+	fs := (ssb / df1) / (ssw / df2)
+	bd.Statistic = optionalValue(fs)
+	bd.PValue = optionalValue(incompleteBeta(df2/2, df1/2, df2/(df2+df1*fs)))
+
+	return bd
+}
+
+// maxStdDiff returns the largest absolute standardized difference
+// between two groups that have subjects.  If sds is nil, the values
+// are proportions, whose standard deviations are derived from the
+// proportions themselves.  Groups without subjects have NaN values.
+func maxStdDiff(values []float64, sds []float64) float64 {
+
+	mx := math.NaN()
+	for a := range values {
+		for b := a + 1; b < len(values); b++ {
+			if math.IsNaN(values[a]) || math.IsNaN(values[b]) {
+				continue
+			}
+			var va, vb float64
+			if sds == nil {
+				va = values[a] * (1 - values[a])
+				vb = values[b] * (1 - values[b])
+			} else {
+				va = sds[a] * sds[a]
+				vb = sds[b] * sds[b]
+			}
+			diff := math.Abs(values[a] - values[b])
+			var d float64
+			switch {
+			case diff == 0:
+				d = 0
+			case va+vb > 0:
+				d = diff / math.Sqrt((va+vb)/2)
+			default:
+				return math.NaN()
+			}
+			if !(d <= mx) {
+				mx = d
+			}
+		}
+	}
+
+	return mx
+}
+
+// contingencyTest tests the association between the rows and columns
+// of a table of counts, and stores the result in bd.  Rows and columns
+// without counts are not used.  Fisher's exact test is used for a two
+// by two table in which an expected count is less than five, and the
+// chi-square test otherwise.
+func contingencyTest(bd *BalanceDiagnostic, table [][]float64) {
+
+	var rows []int
+	var cols []int
+	colTotals := make([]float64, len(table[0]))
+	for k, row := range table {
+		t := 0.0
+		for i, n := range row {
+			t += n
+			colTotals[i] += n
+		}
+		if t > 0 {
+			rows = append(rows, k)
+		}
+	}
+	for i, t := range colTotals {
+		if t > 0 {
+			cols = append(cols, i)
+		}
+	}
+	if len(rows) < 2 || len(cols) < 2 {
+		return
+	}
+
+	// The reduced table and its margins
+	obs := make([][]float64, len(rows))
+	rt := make([]float64, len(rows))
+	ct := make([]float64, len(cols))
+	total := 0.0
+	for a, k := range rows {
+		obs[a] = make([]float64, len(cols))
+		for b, i := range cols {
+			obs[a][b] = table[k][i]
+			rt[a] += table[k][i]
+			ct[b] += table[k][i]
+			total += table[k][i]
+		}
+	}
+
+	chisq, small := 0.0, false
+	for a := range obs {
+		for b := range obs[a] {
+			e := rt[a] * ct[b] / total
+			if e < 5 {
+				small = true
+			}
+			d := obs[a][b] - e
+			chisq += d * d / e
+		}
+	}
+
+	if small && len(rows) == 2 && len(cols) == 2 {
+		bd.Test = "Fisher exact"
+		bd.PValue = optionalValue(fisherExact(obs))
+		return
+	}
+
+	df := (len(rows) - 1) * (len(cols) - 1)
+	bd.Test = "Chi-square"
+	bd.Statistic = optionalValue(chisq)
+	bd.DF = []int{df}
+	bd.PValue = optionalValue(upperIncompleteGamma(float64(df)/2, chisq/2))
+}
+
+// fisherExact returns the two-sided p-value of Fisher's exact test for
+// a two by two table, which is the total probability of the tables
+// with the same margins that are no more probable than the observed
+// table.
+func fisherExact(table [][]float64) float64 {
+
+	r1 := table[0][0] + table[0][1]
+	r2 := table[1][0] + table[1][1]
+	c1 := table[0][0] + table[1][0]
+
+	logProb := func(k float64) float64 {
+		return logChoose(r1, k) + logChoose(r2, c1-k) - logChoose(r1+r2, c1)
+	}
+
+	pobs := logProb(table[0][0])
+	p := 0.0
+	for k := math.Max(0, c1-r2); k <= math.Min(r1, c1); k++ {
+		if lp := logProb(k); lp <= pobs+1e-7 {
+			p += math.Exp(lp)
+		}
+	}
+
+	return math.Min(p, 1)
+}
+
+// logChoose returns the logarithm of the binomial coefficient n
+// choose k.
+func logChoose(n, k float64) float64 {
+
+	a, _ := math.Lgamma(n + 1)
+	b, _ := math.Lgamma(k + 1)
+	c, _ := math.Lgamma(n - k + 1)
+	return a - b - c
+}
+
+// upperIncompleteGamma returns the regularized upper incomplete gamma
+// function Q(a, x), so that the p-value of a chi-square statistic x
+// with d degrees of freedom is Q(d/2, x/2).
+func upperIncompleteGamma(a, x float64) float64 {
+
+	if x <= 0 {
+		return 1
+	}
+	lg, _ := math.Lgamma(a)
+	f := math.Exp(-x + a*math.Log(x) - lg)
+
+	if x < a+1 {
+		// Series expansion of the lower function
+		del := 1 / a
+		sum := del
+		for n := 1; n < 1000; n++ {
+			del *= x / (a + float64(n))
+			sum += del
+			if math.Abs(del) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return math.Max(0, 1-sum*f)
+	}
+
+	// Continued fraction, evaluated by Lentz's method
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < 1e-15 {
+			break
+		}
+	}
+
+	return f * h
+}
+
+// incompleteBeta returns the regularized incomplete beta function
+// I_x(a, b).  The p-value of an F statistic f with d1 and d2 degrees
+// of freedom is I_y(d2/2, d1/2) with y = d2/(d2+d1*f).
+func incompleteBeta(a, b, x float64) float64 {
+
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	bt := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+
+	if x < (a+1)/(a+b+2) {
+		return bt * betaFraction(a, b, x) / a
+	}
+	return 1 - bt*betaFraction(b, a, 1-x)/b
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function by Lentz's method.
+func betaFraction(a, b, x float64) float64 {
+
+	const tiny = 1e-300
+	clamp := func(v float64) float64 {
+		if math.Abs(v) < tiny {
+			return tiny
+		}
+		return v
+	}
+
+	c := 1.0
+	d := 1 / clamp(1-(a+b)*x/(a+1))
+	h := d
+	for m := 1.0; m < 1000; m++ {
+		aa := m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		d = 1 / clamp(1+aa*d)
+		c = clamp(1 + aa/c)
+		h *= d * c
+		aa = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		d = 1 / clamp(1+aa*d)
+		c = clamp(1 + aa/c)
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < 1e-15 {
+			break
+		}
+	}
+
+	return h
+}
+
+// csvOptional formats an optional value for CSV output, using a blank
+// for a missing value.
+func csvOptional(x *float64) string {
+
+	if x == nil {
+		return ""
+	}
+	return fmt.Sprintf("%g", *x)
+}
+
+// formatDF formats the degrees of freedom of a test statistic.
+func formatDF(df []int) string {
+
+	switch len(df) {
+	case 1:
+		return fmt.Sprintf("%d", df[0])
+	case 2:
+		return fmt.Sprintf("%d, %d", df[0], df[1])
+	}
+	return ""
+}
+
+// diagnosticSummary returns one row for each variable, summarizing its
+// balance diagnostics for display.
+func diagnosticSummary(diags []*BalanceDiagnostic) [][]string {
+
+	var rows [][]string
+	for _, bd := range diags {
+		test := "-"
+		if bd.Test != "" {
+			test = bd.Test
+		}
+		stat := formatOptional("%.3f", bd.Statistic)
+		if len(bd.DF) > 0 && bd.Statistic != nil {
+			stat += " (" + formatDF(bd.DF) + ")"
+		}
+		rows = append(rows, []string{
+			bd.Variable,
+			test,
+			stat,
+			formatOptional("%.4f", bd.PValue),
+			formatOptional("%.3f", bd.MaxStdDiff),
+			bd.Func,
+			formatOptional("%.3f", bd.Imbalance),
+		})
+	}
+
+	return rows
+}
+
+// diagnosticLevels returns one row for each level of the categorical
+// variables, and for each continuous variable, for display.  The rows
+// of a categorical variable contain the number of subjects in each
+// group and the percentage of the level's subjects in that group,
+// followed by the standardized difference.  The rows of a continuous
+// variable contain the mean and standard deviation in each group.
+func diagnosticLevels(diags []*BalanceDiagnostic) [][]string {
+
+	var rows [][]string
+	for _, bd := range diags {
+		if bd.Type == "Continuous" {
+			row := []string{bd.Variable + " mean (SD)"}
+			for i := range bd.Means {
+				if bd.Means[i] == nil {
+					row = append(row, "-")
+				} else {
+					row = append(row, fmt.Sprintf("%.2f (%s)", *bd.Means[i], formatOptional("%.2f", bd.SDs[i])))
+				}
+			}
+			rows = append(rows, append(row, formatOptional("%.3f", bd.MaxStdDiff)))
+			continue
+		}
+		for _, ld := range bd.Levels {
+			row := []string{bd.Variable + "=" + ld.Level}
+			for i, n := range ld.Counts {
+				row = append(row, fmt.Sprintf("%d (%s%%)", n, formatOptional("%.1f", ld.LevelPercents[i])))
+			}
+			rows = append(rows, append(row, formatOptional("%.3f", ld.StdDiff)))
+		}
+	}
+
+	return rows
+}
+
+// writeDiagnostics writes the balance diagnostics in CSV format, with
+// one row for each level of the categorical variables and one row for
+// each continuous variable.  The diagnostics of the variable are
+// repeated on each of its rows.
+func writeDiagnostics(w io.Writer, project *Project, diags []*BalanceDiagnostic) error {
+
+	wtr := csv.NewWriter(w)
+
+	header := []string{"Variable", "Type", "Scoring function", "Imbalance", "Test",
+		"Statistic", "DF", "P value", "Level", "Std difference"}
+	for _, g := range project.GroupNames {
+		header = append(header, "N ("+g+")", "Percent of group ("+g+")",
+			"Percent of level ("+g+")", "Mean ("+g+")", "SD ("+g+")")
+	}
+	if err := wtr.Write(header); err != nil {
+		return err
+	}
+
+	for _, bd := range diags {
+		common := []string{bd.Variable, bd.Type, bd.Func, csvOptional(bd.Imbalance), bd.Test,
+			csvOptional(bd.Statistic), formatDF(bd.DF), csvOptional(bd.PValue)}
+
+		if bd.Type == "Continuous" {
+			row := append(append([]string{}, common...), "", csvOptional(bd.MaxStdDiff))
+			for i := range bd.N {
+				row = append(row, fmt.Sprintf("%d", bd.N[i]), "", "",
+					csvOptional(bd.Means[i]), csvOptional(bd.SDs[i]))
+			}
+			if err := wtr.Write(row); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, ld := range bd.Levels {
+			row := append(append([]string{}, common...), ld.Level, csvOptional(ld.StdDiff))
+			for i, n := range ld.Counts {
+				row = append(row, fmt.Sprintf("%d", n), csvOptional(ld.GroupPercents[i]),
+					csvOptional(ld.LevelPercents[i]), "", "")
+			}
+			if err := wtr.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	wtr.Flush()
+	return wtr.Error()
+}
+
+// balanceDiagnosticsFile downloads the balance diagnostics of a
+// project, in CSV or JSON format.
+func balanceDiagnosticsFile(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "balanceDiagnosticsFile: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	diags := balanceDiagnostics(project)
+
+	switch r.FormValue("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=balance_diagnostics.csv")
+		if err := writeDiagnostics(w, project, diags); err != nil {
+			log.Errorf(ctx, "balanceDiagnosticsFile: %v", err)
+		}
+	case "json":
+		report := struct {
+			Project       string
+			GroupNames    []string
+			SamplingRates []float64
+			Assignments   []int
+			Variables     []*BalanceDiagnostic
+		}{
+			Project:       project.Name,
+			GroupNames:    project.GroupNames,
+			SamplingRates: project.SamplingRates,
+			Assignments:   project.Assignments,
+			Variables:     diags,
+		}
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Errorf(ctx, "balanceDiagnosticsFile: %v", err)
+			ServeError(ctx, w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=balance_diagnostics.json")
+		if _, err := w.Write(b); err != nil {
+			log.Errorf(ctx, "balanceDiagnosticsFile: %v", err)
+		}
+	default:
+		Serve404(w)
+	}
+}
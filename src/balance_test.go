@@ -0,0 +1,119 @@
+package randomization
+
+import (
+	"math"
+	"testing"
+)
+
+// The reference values below are from standard statistical tables, or
+// can be reproduced with R, for example pchisq(3.841459, 1,
+// lower.tail=FALSE) or fisher.test(matrix(c(3, 1, 1, 3), 2)).
+
+func TestUpperIncompleteGamma(t *testing.T) {
+
+	for _, tc := range []struct {
+		df, x, p float64
+	}{
+		{1, 3.841459, 0.05},
+		{1, 6.634897, 0.01},
+		{2, 5.991465, 0.05},
+		{5, 11.070498, 0.05},
+		{10, 18.307038, 0.05},
+		{30, 29.335944, 0.5},
+		{4, 0.5, 0.973501},
+	} {
+		p := upperIncompleteGamma(tc.df/2, tc.x/2)
+		if math.Abs(p-tc.p) > 1e-5 {
+			t.Errorf("chi-square p-value for x=%v, df=%v: got %v, want %v", tc.x, tc.df, p, tc.p)
+		}
+	}
+
+	// Q(1, x) = exp(-x)
+	for _, x := range []float64{0.1, 1, 2.5, 10} {
+		if q := upperIncompleteGamma(1, x); math.Abs(q-math.Exp(-x)) > 1e-10 {
+			t.Errorf("Q(1, %v): got %v, want %v", x, q, math.Exp(-x))
+		}
+	}
+
+	if q := upperIncompleteGamma(3, 0); q != 1 {
+		t.Errorf("Q(3, 0): got %v, want 1", q)
+	}
+}
+
+func TestIncompleteBeta(t *testing.T) {
+
+	// I_0.4(2, 3) = P(Binomial(4, 0.4) >= 2)
+	if v := incompleteBeta(2, 3, 0.4); math.Abs(v-0.5248) > 1e-10 {
+		t.Errorf("I_0.4(2, 3): got %v, want 0.5248", v)
+	}
+
+	// I_x(1, 1) = x
+	for _, x := range []float64{0.1, 0.5, 0.9} {
+		if v := incompleteBeta(1, 1, x); math.Abs(v-x) > 1e-10 {
+			t.Errorf("I_%v(1, 1): got %v", x, v)
+		}
+	}
+
+	if incompleteBeta(2, 5, 0) != 0 || incompleteBeta(2, 5, 1) != 1 {
+		t.Errorf("the incomplete beta function is not 0 at 0 and 1 at 1")
+	}
+}
+
+func TestFDistribution(t *testing.T) {
+
+	// The p-value of an F statistic, as in continuousDiagnostic.
+	for _, tc := range []struct {
+		df1, df2, f, p float64
+	}{
+		{2, 10, 4.102821, 0.05},
+		{1, 20, 4.351244, 0.05},
+		{3, 30, 4.509910, 0.01},
+		{4, 100, 1, 0.411},
+	} {
+		p := incompleteBeta(tc.df2/2, tc.df1/2, tc.df2/(tc.df2+tc.df1*tc.f))
+		if math.Abs(p-tc.p) > 1e-3 {
+			t.Errorf("F(%v, %v) = %v: got p=%v, want %v", tc.df1, tc.df2, tc.f, p, tc.p)
+		}
+	}
+}
+
+func TestFisherExact(t *testing.T) {
+
+	for _, tc := range []struct {
+		table [][]float64
+		p     float64
+	}{
+		// The tea tasting experiment
+		{[][]float64{{3, 1}, {1, 3}}, 0.485714},
+		{[][]float64{{1, 9}, {11, 3}}, 0.002759},
+		{[][]float64{{4, 0}, {0, 4}}, 0.028571},
+		{[][]float64{{2, 2}, {2, 2}}, 1},
+	} {
+		p := fisherExact(tc.table)
+		if math.Abs(p-tc.p) > 1e-5 {
+			t.Errorf("Fisher exact test of %v: got %v, want %v", tc.table, p, tc.p)
+		}
+	}
+}
+
+func TestContingencyTest(t *testing.T) {
+
+	// A two by two table with small expected counts uses the
+	// Fisher exact test.
+	bd := new(BalanceDiagnostic)
+	contingencyTest(bd, [][]float64{{3, 1}, {1, 3}})
+	if bd.Test != "Fisher exact" || math.Abs(*bd.PValue-0.485714) > 1e-5 {
+		t.Errorf("small table: got test %q, p-value %v", bd.Test, *bd.PValue)
+	}
+
+	// Pearson's chi-square test without continuity correction,
+	// as in chisq.test(correct=FALSE).  Empty rows are dropped.
+	bd = new(BalanceDiagnostic)
+	contingencyTest(bd, [][]float64{{20, 30}, {0, 0}, {30, 20}})
+	if bd.Test != "Chi-square" || bd.DF[0] != 1 {
+		t.Fatalf("large table: got test %q, df %v", bd.Test, bd.DF)
+	}
+	if math.Abs(*bd.Statistic-4) > 1e-10 || math.Abs(*bd.PValue-0.0455003) > 1e-6 {
+		t.Errorf("large table: got statistic %v, p-value %v", *bd.Statistic, *bd.PValue)
+	}
+}
@@ -0,0 +1,640 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// maxBatchSize is the largest number of subjects that can be assigned
+// jointly in one batch.
+const maxBatchSize = 10
+
+// BatchAssignment records the joint assignment of a batch of subjects,
+// such as a matched pair, who were enrolled at the same time.
+type BatchAssignment struct {
+	Time       time.Time
+	Assigner   string
+	SubjectIds []string
+	Site       string
+	Seed       int64
+
+	// Either "Split", in which the subjects are divided among the
+	// groups in proportion to the sampling rates, or "Balance", in
+	// which the allocation is selected for the best balance of the
+	// variables.
+	Mode string
+
+	// The proportion of the candidate allocations, ordered by their
+	// balance, from which the allocation was selected (Balance
+	// mode only).
+	Fraction float64
+
+	// The number of candidate allocations, and whether they are all
+	// possible allocations or a random sample (Balance mode only).
+	NumCandidates int
+	Enumerated    bool
+
+	// The assigned group of each subject.
+	Groups []string
+}
+
+// batchAllowed returns true if subjects can be assigned in batches
+// with the project's allocation method.  Methods that keep their own
+// allocation state, such as permuted blocks, assign one subject at a
+// time.
+func batchAllowed(project *Project) bool {
+	return project.Method == "Minimization" || project.Method == "Simple"
+}
+
+// copyAggregates returns copies of the given aggregate data and group
+// sizes.
+func copyAggregates(project *Project, data [][][]float64, counts []int) ([][][]float64, []int) {
+
+	d := newAggregateData(project)
+	for j := range data {
+		for k := range data[j] {
+			copy(d[j][k], data[j][k])
+		}
+	}
+	cnt := make([]int, len(counts))
+	copy(cnt, counts)
+
+	return d, cnt
+}
+
+// batchScore returns the total minimization score of assigning the
+// subjects with the given values to the groups in a, one after the
+// other, as calculated by minimizationScores with the project's
+// scoring functions and weights.  The total amount by which the
+// maximum tolerated imbalances are exceeded along the way, as
+// calculated by imbalanceExcess, is also returned.  The aggregate data
+// of the project are not changed.
+func batchScore(project *Project, site string, values [][]string, a []int) (float64, float64, error) {
+
+	tmp := *project
+	tmp.Data, tmp.Assignments = copyAggregates(project, project.Data, project.Assignments)
+	if site != "" {
+		sdata, scounts := siteAggregates(project, site)
+		sdata, scounts = copyAggregates(project, sdata, scounts)
+		tmp.SiteData = map[string][][][]float64{site: sdata}
+		tmp.SiteAssignments = map[string][]int{site: scounts}
+	}
+
+	var score, excess float64
+	for k, grp := range a {
+		M := make(map[string]string)
+		for j, va := range project.Variables {
+			M[va.Name] = values[k][j]
+		}
+		scores, err := minimizationScores(&M, site, &tmp)
+		if err != nil {
+			return 0, 0, err
+		}
+		score += scores[grp]
+		excess += imbalanceExcess(&M, &tmp)[grp]
+
+		tmp.Assignments[grp]++
+		if err := addCluster(project, tmp.Data, values[k], grp); err != nil {
+			return 0, 0, err
+		}
+		if err := updateSiteAggregates(&tmp, site, values[k], grp, 1); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return score, excess, nil
+}
+
+// feasibleAllocations returns the positions of the candidate
+// allocations that do not exceed the maximum tolerated imbalances.  If
+// every candidate exceeds them, the candidates that exceed them the
+// least are returned, as in the deterministic assignment of
+// minimization.
+func feasibleAllocations(excess []float64) []int {
+
+	minExcess := math.Inf(1)
+	for _, x := range excess {
+		minExcess = math.Min(minExcess, x)
+	}
+
+	var feasible []int
+	for c, x := range excess {
+		if x == minExcess {
+			feasible = append(feasible, c)
+		}
+	}
+
+	return feasible
+}
+
+// selectBatch checks the data of a batch of subjects, and returns the
+// position of the group selected for each subject, using a random
+// number generator with the given seed.  The aggregate data are not
+// updated.  In Split mode, the numbers of subjects in the groups are
+// made proportional to the sampling rates within the batch, so that
+// for example the subjects of a matched pair are assigned to different
+// groups, and the subjects are allocated to the groups at random.  In
+// Balance mode, the numbers of subjects in the groups are made
+// proportional to the sampling rates over all subjects, and one
+// allocation is selected at random from the given fraction of the
+// candidate allocations with the smallest minimization scores, see
+// batchScore.  In both modes, allocations that would exceed the
+// maximum tolerated imbalances are rejected unless no allocation
+// avoids them.  The number of candidate allocations, and whether they
+// are all possible allocations, are also returned.
+func selectBatch(project *Project, values [][]string, site string, mode string, fraction float64, seed int64) ([]int, int, bool, error) {
+
+	m := len(values)
+	if m < 2 || m > maxBatchSize {
+		return nil, 0, false, fmt.Errorf("a batch must contain between 2 and %d subjects", maxBatchSize)
+	}
+
+	for _, x := range values {
+		M := make(map[string]string)
+		for j, va := range project.Variables {
+			M[va.Name] = x[j]
+		}
+		if err := checkSubjectData(&M, project); err != nil {
+			return nil, 0, false, err
+		}
+	}
+
+	if len(project.Sites) > 0 && getIndex(project.Sites, site) == -1 {
+		return nil, 0, false, fmt.Errorf("Invalid site '%s'", site)
+	}
+
+	rgen := rand.New(rand.NewSource(seed))
+
+	switch mode {
+	case "Split":
+		n := clusterTargets(project, make([]int, len(project.GroupNames)), m, rgen)
+		cands, _ := candidateAllocations(n, rgen)
+		excess := make([]float64, len(cands))
+		for c, a := range cands {
+			_, x, err := batchScore(project, site, values, a)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			excess[c] = x
+		}
+		feasible := feasibleAllocations(excess)
+		return cands[feasible[rgen.Intn(len(feasible))]], 0, false, nil
+	case "Balance":
+		if fraction <= 0 || fraction > 1 {
+			return nil, 0, false, fmt.Errorf("the acceptable fraction must be greater than 0 and no greater than 1")
+		}
+		counts := project.Assignments
+		if site != "" {
+			_, counts = siteAggregates(project, site)
+		}
+		n := clusterTargets(project, counts, m, rgen)
+		cands, enumerated := candidateAllocations(n, rgen)
+		scores := make([]float64, len(cands))
+		excess := make([]float64, len(cands))
+		for c, a := range cands {
+			s, x, err := batchScore(project, site, values, a)
+			if err != nil {
+				return nil, 0, false, err
+			}
+			scores[c], excess[c] = s, x
+		}
+		feasible := feasibleAllocations(excess)
+		fscores := make([]float64, len(feasible))
+		for i, c := range feasible {
+			fscores[i] = scores[c]
+		}
+		acceptable := acceptableAllocations(fscores, fraction)
+		return cands[feasible[acceptable[rgen.Intn(len(acceptable))]]], len(cands), enumerated, nil
+	}
+
+	return nil, 0, false, fmt.Errorf("unknown batch mode '%s'", mode)
+}
+
+// assignBatch jointly assigns a batch of new subjects to treatment
+// groups, and updates the project to reflect the assignments.  The
+// batch is recorded as a single event in project.Batches.
+func assignBatch(project *Project, subjectIds []string, values [][]string, site string, mode string, fraction float64, userId string) (*BatchAssignment, error) {
+
+	if !batchAllowed(project) {
+		return nil, fmt.Errorf("subjects cannot be assigned in batches with this allocation method")
+	}
+
+	seed, err := newSeed()
+	if err != nil {
+		return nil, err
+	}
+
+	groups, ncand, enumerated, err := selectBatch(project, values, site, mode, fraction, seed)
+	if err != nil {
+		return nil, err
+	}
+
+	ba := &BatchAssignment{
+		Time:          time.Now(),
+		Assigner:      userId,
+		SubjectIds:    subjectIds,
+		Site:          site,
+		Seed:          seed,
+		Mode:          mode,
+		NumCandidates: ncand,
+		Enumerated:    enumerated,
+		Groups:        make([]string, len(groups)),
+	}
+	if mode == "Balance" {
+		ba.Fraction = fraction
+	}
+
+	for k, ii := range groups {
+		M := make(map[string]string)
+		for j, va := range project.Variables {
+			M[va.Name] = values[k][j]
+		}
+		rec, err := recordAssignment(&M, site, project, ii, subjectIds[k], userId, seed)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			rec.AssignedTime = ba.Time
+			rec.Batch = len(project.Batches) + 1
+		}
+		ba.Groups[k] = project.GroupNames[ii]
+	}
+	project.Batches = append(project.Batches, ba)
+
+	return ba, nil
+}
+
+// batchSize returns the number of subjects in a batch from the form
+// value s, or 2 if s is blank.
+func batchSize(s string) (int, error) {
+
+	if s == "" {
+		return 2, nil
+	}
+	m, err := strconv.Atoi(s)
+	if err != nil || m < 2 || m > maxBatchSize {
+		return 0, fmt.Errorf("The number of subjects in a batch must be between 2 and %d.", maxBatchSize)
+	}
+
+	return m, nil
+}
+
+// batchField returns the name of the form field containing the value
+// of the named variable for subject k of a batch.
+func batchField(name string, k int) string {
+	return fmt.Sprintf("%s_%d", name, k)
+}
+
+// assignBatchInput displays a form to enter the data for a batch of
+// subjects.
+func assignBatchInput(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	PR, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "assignBatchInput: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if !PR.Open {
+		msg := "This project is currently not open for new enrollments.  The project owner can change this by following the \"Open/close enrollment\" link on the project dashboard."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !batchAllowed(PR) {
+		msg := "Subjects can only be assigned in batches in projects that use minimization or simple randomization."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	size, err := batchSize(r.FormValue("size"))
+	if err != nil {
+		msg := err.Error()
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var sizes []int
+	for m := 2; m <= maxBatchSize; m++ {
+		sizes = append(sizes, m)
+	}
+	rows := make([]int, size)
+	for k := range rows {
+		rows[k] = k
+	}
+
+	tvals := struct {
+		User      string
+		LoggedIn  bool
+		PR        *Project
+		PV        *ProjectView
+		NumGroups int
+		Pkey      string
+		AnySites  bool
+		Site      string
+		Size      int
+		Sizes     []int
+		Rows      []int
+	}{
+		User:      user.String(),
+		LoggedIn:  user != nil,
+		PR:        PR,
+		PV:        formatProject(PR),
+		NumGroups: len(PR.GroupNames),
+		Pkey:      pkey,
+		AnySites:  len(PR.Sites) > 0,
+		Site:      PR.UserSites[strings.ToLower(user.String())],
+		Size:      size,
+		Sizes:     sizes,
+		Rows:      rows,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "assign_batch_input.html", tvals); err != nil {
+		log.Errorf(ctx, "assignBatchInput failed to execute template: %v", err)
+	}
+}
+
+// assignBatchConfirm displays the data entered for a batch of subjects
+// for confirmation.
+func assignBatchConfirm(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "assignBatchConfirm: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	size, err := batchSize(r.FormValue("size"))
+	if err != nil {
+		msg := err.Error()
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	site := r.FormValue("site")
+	if len(project.Sites) > 0 && getIndex(project.Sites, site) == -1 {
+		msg := "Please select the site at which the subjects are enrolled."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	fraction, err := strconv.ParseFloat(r.FormValue("fraction"), 64)
+	if mode == "Balance" && (err != nil || fraction <= 0 || fraction > 1) {
+		msg := "The acceptable fraction must be a number greater than 0 and no greater than 1."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectIds := make([]string, size)
+	rows := make([][]string, size)
+	values := make([]string, size)
+	for k := 0; k < size; k++ {
+		subjectIds[k] = strings.TrimSpace(r.FormValue(fmt.Sprintf("subject_id%d", k)))
+		if !checkBeforeAssigning(project, pkey, subjectIds[k], user, w, r) {
+			return
+		}
+		for _, id := range subjectIds[:k] {
+			if project.StoreRawData && id == subjectIds[k] {
+				msg := fmt.Sprintf("Subject '%s' is listed more than once in the batch.", id)
+				rmsg := "Return to project"
+				messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+				return
+			}
+		}
+
+		mpv := make(map[string]string)
+		x := make([]string, len(project.Variables))
+		for j, va := range project.Variables {
+			x[j] = strings.TrimSpace(r.FormValue(batchField(va.Name, k)))
+			mpv[va.Name] = x[j]
+		}
+		if err := checkSubjectData(&mpv, project); err != nil {
+			msg := fmt.Sprintf("%v.", err)
+			rmsg := "Return to project"
+			messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+
+		rows[k] = []string{subjectIds[k]}
+		for _, v := range x {
+			if v == "" {
+				v = "(missing)"
+			}
+			rows[k] = append(rows[k], v)
+		}
+		values[k] = strings.Join(x, ",")
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		Project     *Project
+		ProjectView *ProjectView
+		NumGroups   int
+		Rows        [][]string
+		SubjectIds  []string
+		Values      []string
+		Size        int
+		Site        string
+		Mode        string
+		Fraction    string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		Pkey:        pkey,
+		Project:     project,
+		ProjectView: formatProject(project),
+		NumGroups:   len(project.GroupNames),
+		Rows:        rows,
+		SubjectIds:  subjectIds,
+		Values:      values,
+		Size:        size,
+		Site:        site,
+		Mode:        mode,
+		Fraction:    r.FormValue("fraction"),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "assign_batch_confirm.html", tvals); err != nil {
+		log.Errorf(ctx, "assignBatchConfirm failed to execute template: %v", err)
+	}
+}
+
+// assignBatchPage assigns a batch of subjects to treatment groups.
+func assignBatchPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "assignBatchPage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	size, err := batchSize(r.FormValue("size"))
+	if err != nil {
+		msg := err.Error()
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	mode := r.FormValue("mode")
+	if mode != "Split" && mode != "Balance" {
+		msg := "Please select how the subjects of the batch are allocated."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// Check the subject ids, as in assignBatchConfirm, in case
+	// someone lands on this page without going through those checks.
+	subjectIds := make([]string, size)
+	values := make([][]string, size)
+	for k := 0; k < size; k++ {
+		subjectIds[k] = strings.TrimSpace(r.FormValue(fmt.Sprintf("subject_id%d", k)))
+		if !checkBeforeAssigning(project, pkey, subjectIds[k], user, w, r) {
+			return
+		}
+		for _, id := range subjectIds[:k] {
+			if project.StoreRawData && id == subjectIds[k] {
+				msg := fmt.Sprintf("Subject '%s' is listed more than once in the batch.", id)
+				rmsg := "Return to project"
+				messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+				return
+			}
+		}
+		values[k] = make([]string, len(project.Variables))
+		if len(project.Variables) > 0 {
+			x := strings.Split(r.FormValue(fmt.Sprintf("values%d", k)), ",")
+			copy(values[k], x)
+		}
+	}
+
+	fraction, _ := strconv.ParseFloat(r.FormValue("fraction"), 64)
+	ba, err := assignBatch(project, subjectIds, values, r.FormValue("site"), mode, fraction, user.String())
+	if err != nil {
+		log.Errorf(ctx, "%v", err)
+		msg := fmt.Sprintf("The subjects were not assigned to treatment groups: %v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	allocation := "split across the groups"
+	if ba.Mode == "Balance" {
+		allocation = fmt.Sprintf("best balance, acceptable fraction %v", ba.Fraction)
+	}
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{
+		fmt.Sprintf("Subjects '%s' assigned as batch %d (%s, seed %d).",
+			strings.Join(ba.SubjectIds, "', '"), len(project.Batches), allocation, ba.Seed)}
+	project.Comments = append(project.Comments, comment)
+
+	project.Modified = time.Now()
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "assignBatchPage: %v", err)
+		msg := "A datastore error occured, the project could not be updated."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	rows := make([][]string, len(ba.Groups))
+	for k, g := range ba.Groups {
+		rows[k] = []string{ba.SubjectIds[k], g}
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		Rows        [][]string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		Pkey:        pkey,
+		ProjectName: project.Name,
+		Rows:        rows,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "assign_batch.html", tvals); err != nil {
+		log.Errorf(ctx, "assignBatchPage failed to execute template: %v", err)
+	}
+}
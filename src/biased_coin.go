@@ -0,0 +1,110 @@
+package randomization
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// biasedCoin implements Efron's biased coin design (Biometrika 58,
+// 1971) for projects with two treatment groups.  When the groups are
+// balanced, the assignment is made with probabilities proportional to
+// the sampling rates.  Otherwise, the subject is assigned to the
+// under-represented group with probability CoinProb.
+type biasedCoin struct{}
+
+func (biasedCoin) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	d, err := twoGroupImbalance(project)
+	if err != nil {
+		return -1, err
+	}
+
+	switch {
+	case d < 0:
+		if rgen.Float64() < project.CoinProb {
+			return 0, nil
+		}
+		return 1, nil
+	case d > 0:
+		if rgen.Float64() < project.CoinProb {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return sampleIndex(project.SamplingRates, rgen), nil
+	}
+}
+
+func (biasedCoin) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	d, err := twoGroupImbalance(project)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case d < 0:
+		return []float64{project.CoinProb, 1 - project.CoinProb}, nil
+	case d > 0:
+		return []float64{1 - project.CoinProb, project.CoinProb}, nil
+	default:
+		return rateProbs(project), nil
+	}
+}
+
+// bigStick implements the big stick design of Soares and Wu
+// (Communications in Statistics 12, 1983) for projects with two
+// treatment groups.  The assignments are made with probabilities
+// proportional to the sampling rates, unless the imbalance has
+// reached MaxImbalance, in which case the subject is assigned to the
+// under-represented group.
+type bigStick struct{}
+
+func (bigStick) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	d, err := twoGroupImbalance(project)
+	if err != nil {
+		return -1, err
+	}
+
+	switch {
+	case d <= -float64(project.MaxImbalance):
+		return 0, nil
+	case d >= float64(project.MaxImbalance):
+		return 1, nil
+	default:
+		return sampleIndex(project.SamplingRates, rgen), nil
+	}
+}
+
+func (bigStick) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	d, err := twoGroupImbalance(project)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case d <= -float64(project.MaxImbalance):
+		return []float64{1, 0}, nil
+	case d >= float64(project.MaxImbalance):
+		return []float64{0, 1}, nil
+	default:
+		return rateProbs(project), nil
+	}
+}
+
+// twoGroupImbalance returns the difference between the numbers of
+// subjects assigned to the first and second treatment groups, after
+// dividing each by its sampling rate.
+func twoGroupImbalance(project *Project) (float64, error) {
+
+	if len(project.GroupNames) != 2 {
+		return 0, fmt.Errorf("The %s design requires exactly two treatment groups", project.Method)
+	}
+
+	rates := project.SamplingRates
+	d := float64(project.Assignments[0])/rates[0] - float64(project.Assignments[1])/rates[1]
+
+	return d, nil
+}
@@ -0,0 +1,237 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// permutedBlocks assigns the subjects using permuted blocks.  The size
+// of each block is selected at random from the project's block sizes,
+// and within each block the numbers of subjects assigned to the
+// groups are proportional to the sampling rates.
+type permutedBlocks struct{}
+
+func (permutedBlocks) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	return nextInBlock(project, "", rgen)
+}
+
+func (permutedBlocks) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	return blockProbs(project, ""), nil
+}
+
+// stratifiedBlocks assigns the subjects using a separate sequence of
+// permuted blocks within each stratum.  The strata are the cross
+// classified levels of the project variables.
+type stratifiedBlocks struct{}
+
+func (stratifiedBlocks) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	values := make([]string, len(project.Variables))
+	for j, va := range project.Variables {
+		x := (*M)[va.Name]
+		if getIndex(va.Levels, x) == -1 {
+			return -1, fmt.Errorf("Invalid value '%s' for variable '%s'", x, va.Name)
+		}
+		values[j] = x
+	}
+
+	return nextInBlock(project, stratumKey(values), rgen)
+}
+
+func (stratifiedBlocks) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
+
+	values := make([]string, len(project.Variables))
+	for j, va := range project.Variables {
+		values[j] = (*M)[va.Name]
+	}
+
+	return blockProbs(project, stratumKey(values)), nil
+}
+
+// stratumKey returns the key of the stratum containing a subject with
+// the given values of the project variables.
+func stratumKey(values []string) string {
+	return strings.Join(values, ",")
+}
+
+// updateStratumAssignments adds d to the number of subjects assigned
+// to group grp within the given stratum.
+func updateStratumAssignments(project *Project, key string, grp int, d int) {
+
+	if project.StratumAssignments[key] == nil {
+		project.StratumAssignments[key] = make([]int, len(project.GroupNames))
+	}
+	project.StratumAssignments[key][grp] += d
+}
+
+// numStrata returns the number of strata formed by cross classifying
+// the levels of all the project variables.
+func numStrata(project *Project) int {
+
+	n := 1
+	for _, va := range project.Variables {
+		n *= len(va.Levels)
+	}
+	return n
+}
+
+// strataWarning returns a warning message if there are too many strata
+// for the planned sample size, otherwise it returns an empty string.
+// Following Kernan et al. (J Clin Epidemiol 52, 1999), the number of
+// strata should be less than the planned sample size divided by the
+// block size, otherwise many of the blocks will be incomplete at the
+// end of the trial and the overall balance may be poor.
+func strataWarning(project *Project) string {
+
+	if project.StratumAssignments == nil || project.PlannedSize <= 0 {
+		return ""
+	}
+
+	maxSize := 0
+	for _, x := range project.BlockSizes {
+		if x > maxSize {
+			maxSize = x
+		}
+	}
+
+	ns := numStrata(project)
+	if ns*maxSize <= project.PlannedSize {
+		return ""
+	}
+
+	return fmt.Sprintf("The project has %d strata, which is too many for the planned sample size "+
+		"of %d subjects with blocks of up to %d subjects.  Many blocks will be incomplete at the "+
+		"end of the trial, so the treatment groups may not be balanced.  Consider using fewer "+
+		"variables or combining some of their levels.", ns, project.PlannedSize, maxSize)
+}
+
+// nextInBlock returns the next group from the current block of the
+// given stratum, starting a new block if the current block has been
+// used up.  The block position is advanced, so that the project must
+// be stored after calling this function.
+func nextInBlock(project *Project, stratum string, rgen *rand.Rand) (int, error) {
+
+	if project.Blocks == nil {
+		project.Blocks = make(map[string]*Block)
+	}
+
+	block := project.Blocks[stratum]
+	if block == nil || block.Position >= len(block.Sequence) {
+		var err error
+		block, err = newBlock(project, rgen)
+		if err != nil {
+			return -1, err
+		}
+		project.Blocks[stratum] = block
+	}
+
+	grp := block.Sequence[block.Position]
+	block.Position++
+
+	return grp, nil
+}
+
+// blockProbs returns the probability of each group for the next
+// subject in the given stratum.  Within a block, the remaining
+// positions are equally likely to hold each of the remaining groups.
+// When a new block is started, the probabilities are proportional to
+// the sampling rates, whatever the block size.
+func blockProbs(project *Project, stratum string) []float64 {
+
+	block := project.Blocks[stratum]
+	if block == nil || block.Position >= len(block.Sequence) {
+		return rateProbs(project)
+	}
+
+	probs := make([]float64, len(project.GroupNames))
+	rest := block.Sequence[block.Position:]
+	for _, grp := range rest {
+		probs[grp] += 1 / float64(len(rest))
+	}
+
+	return probs
+}
+
+// newBlock returns a randomly permuted block, whose size is selected
+// at random from the block sizes of the project.
+func newBlock(project *Project, rgen *rand.Rand) (*Block, error) {
+
+	if len(project.BlockSizes) == 0 {
+		return nil, fmt.Errorf("No block sizes are defined for project '%s'", project.Name)
+	}
+
+	size := project.BlockSizes[rgen.Intn(len(project.BlockSizes))]
+	counts, err := blockCounts(size, project.SamplingRates)
+	if err != nil {
+		return nil, err
+	}
+
+	grps := make([]int, 0, size)
+	for i, n := range counts {
+		for k := 0; k < n; k++ {
+			grps = append(grps, i)
+		}
+	}
+
+	seq := make([]int, size)
+	for i, j := range rgen.Perm(size) {
+		seq[i] = grps[j]
+	}
+
+	return &Block{Sequence: seq}, nil
+}
+
+// blockCounts returns the number of subjects that are assigned to each
+// group within a block of the given size.  The sampling rates must be
+// whole numbers, and the block size must be a multiple of their sum.
+func blockCounts(size int, rates []float64) ([]int, error) {
+
+	tot := 0
+	for _, x := range rates {
+		if x != math.Floor(x) || x <= 0 {
+			return nil, fmt.Errorf("The sampling rates must be positive whole numbers when using blocks.")
+		}
+		tot += int(x)
+	}
+
+	if size <= 0 || size%tot != 0 {
+		return nil, fmt.Errorf("The block size %d is not a multiple of %d, the sum of the sampling rates.", size, tot)
+	}
+
+	counts := make([]int, len(rates))
+	for i, x := range rates {
+		counts[i] = int(x) * size / tot
+	}
+
+	return counts, nil
+}
+
+// parseBlockSizes converts a comma separated list of block sizes to
+// numbers, and checks that each block size is compatible with the
+// sampling rates.
+func parseBlockSizes(s string, rates []float64) ([]int, error) {
+
+	parts := cleanSplit(s, ",")
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("At least one block size must be provided.")
+	}
+
+	sizes := make([]int, len(parts))
+	for i, x := range parts {
+		n, err := strconv.Atoi(x)
+		if err != nil {
+			return nil, fmt.Errorf("The block size '%s' is not a whole number.", x)
+		}
+		if _, err := blockCounts(n, rates); err != nil {
+			return nil, err
+		}
+		sizes[i] = n
+	}
+
+	return sizes, nil
+}
@@ -0,0 +1,238 @@
+package randomization
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"math"
+	"sort"
+	"time"
+)
+
+// The dimensions of the charts and their plotting areas, in pixels.
+const (
+	chartWidth  = 720
+	chartHeight = 300
+	chartLeft   = 60
+	chartRight  = 560
+	chartTop    = 30
+	chartBottom = 250
+)
+
+// chartColors are the colors of the lines of a chart, which are
+// reused if there are more lines.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd",
+	"#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+// byAssignedTime sorts data records by their time of assignment.
+type byAssignedTime []*DataRecord
+
+func (a byAssignedTime) Len() int           { return len(a) }
+func (a byAssignedTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byAssignedTime) Less(i, j int) bool { return a[i].AssignedTime.Before(a[j].AssignedTime) }
+
+// EnrollmentHistory contains the numbers of subjects in the treatment
+// groups and the imbalance of the variables after each assignment, in
+// the order of enrollment.
+type EnrollmentHistory struct {
+	NumSubjects int
+	First       time.Time
+	Last        time.Time
+
+	// The cumulative number of subjects in each group.
+	Enrollment [][]float64
+
+	// The imbalance of each variable, NaN where it is not defined.
+	Imbalance [][]float64
+}
+
+// enrollmentHistory reconstructs the enrollment and the imbalance of
+// the variables over time from the stored data, ordered by the time of
+// assignment.  Each subject is counted in the group to which it was
+// assigned, with the values of the variables that were known at the
+// time, including subjects who were later removed.  The imbalance is
+// calculated as in the balance diagnostics, see variableImbalance.
+func enrollmentHistory(project *Project) *EnrollmentHistory {
+
+	recs := make([]*DataRecord, len(project.RawData))
+	copy(recs, project.RawData)
+	sort.Stable(byAssignedTime(recs))
+
+	numGroups := len(project.GroupNames)
+	eh := &EnrollmentHistory{
+		Enrollment: make([][]float64, numGroups),
+		Imbalance:  make([][]float64, len(project.Variables)),
+	}
+
+	counts := make([]float64, numGroups)
+	data := newAggregateData(project)
+	for _, rec := range recs {
+		grp := getIndex(project.GroupNames, rec.AssignedGroup)
+		if grp == -1 {
+			continue
+		}
+		if eh.NumSubjects == 0 {
+			eh.First = rec.AssignedTime
+		}
+		eh.Last = rec.AssignedTime
+		eh.NumSubjects++
+
+		counts[grp]++
+		for i, n := range counts {
+			eh.Enrollment[i] = append(eh.Enrollment[i], n)
+		}
+
+		values := assignedValues(project, rec)
+		for j, va := range project.Variables {
+			_ = updateVariableData(&va, data[j], values[j], grp, 1)
+			eh.Imbalance[j] = append(eh.Imbalance[j], variableImbalance(&va, data[j], project.SamplingRates))
+		}
+	}
+
+	return eh
+}
+
+// chartStep returns a round step between the axis ticks, so that there
+// are about n ticks up to mx.
+func chartStep(mx float64, n int) float64 {
+
+	raw := mx / float64(n)
+	p := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5} {
+		if m*p >= raw {
+			return m * p
+		}
+	}
+	return 10 * p
+}
+
+// lineChart renders a chart in SVG format with one line for each
+// series, plotted against the positions 1, 2, ... of its values.  NaN
+// values are not drawn.
+func lineChart(title, xlabel, ylabel string, names []string, series [][]float64) template.HTML {
+
+	n := 0
+	ymax := 0.0
+	for _, s := range series {
+		if len(s) > n {
+			n = len(s)
+		}
+		for _, y := range s {
+			if !math.IsNaN(y) && !math.IsInf(y, 0) && y > ymax {
+				ymax = y
+			}
+		}
+	}
+	if ymax == 0 {
+		ymax = 1
+	}
+	xmax := float64(n)
+	if xmax < 1 {
+		xmax = 1
+	}
+
+	ystep := chartStep(ymax, 5)
+	ymax = ystep * math.Ceil(ymax/ystep)
+	xstep := math.Max(1, chartStep(xmax, 6))
+
+	px := func(x float64) float64 {
+		return chartLeft + (x/xmax)*(chartRight-chartLeft)
+	}
+	py := func(y float64) float64 {
+		return chartBottom - (y/ymax)*(chartBottom-chartTop)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="Verdana, sans-serif" font-size="11">`,
+		chartWidth, chartHeight)
+	fmt.Fprintf(&buf, `<text x="%d" y="18" font-size="13" font-weight="bold">%s</text>`,
+		chartLeft, template.HTMLEscapeString(title))
+
+	// Axes, ticks and grid lines
+	ydec := int(math.Max(0, -math.Floor(math.Log10(ystep))))
+	for i := 0; float64(i)*ystep <= ymax+ystep/2; i++ {
+		y := float64(i) * ystep
+		fmt.Fprintf(&buf, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#ddd"/>`, chartLeft, py(y), chartRight, py(y))
+		fmt.Fprintf(&buf, `<text x="%d" y="%.1f" text-anchor="end">%.*f</text>`, chartLeft-5, py(y)+4, ydec, y)
+	}
+	for i := 0; float64(i)*xstep <= xmax; i++ {
+		x := float64(i) * xstep
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="#000"/>`, px(x), chartBottom, px(x), chartBottom+4)
+		fmt.Fprintf(&buf, `<text x="%.1f" y="%d" text-anchor="middle">%.0f</text>`, px(x), chartBottom+16, x)
+	}
+	fmt.Fprintf(&buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#000"/>`, chartLeft, chartBottom, chartRight, chartBottom)
+	fmt.Fprintf(&buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#000"/>`, chartLeft, chartTop, chartLeft, chartBottom)
+	fmt.Fprintf(&buf, `<text x="%d" y="%d" text-anchor="middle">%s</text>`,
+		(chartLeft+chartRight)/2, chartBottom+36, template.HTMLEscapeString(xlabel))
+	fmt.Fprintf(&buf, `<text x="15" y="%d" text-anchor="middle" transform="rotate(-90 15 %d)">%s</text>`,
+		(chartTop+chartBottom)/2, (chartTop+chartBottom)/2, template.HTMLEscapeString(ylabel))
+
+	// The lines, which are broken at missing values
+	for k, s := range series {
+		color := chartColors[k%len(chartColors)]
+		var path bytes.Buffer
+		move := true
+		for i, y := range s {
+			if math.IsNaN(y) || math.IsInf(y, 0) {
+				move = true
+				continue
+			}
+			cmd := "L"
+			if move {
+				cmd = "M"
+				move = false
+			}
+			fmt.Fprintf(&path, "%s%.1f %.1f ", cmd, px(float64(i+1)), py(y))
+		}
+		if path.Len() > 0 {
+			fmt.Fprintf(&buf, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, path.String(), color)
+		}
+
+		// Legend
+		ly := chartTop + 10 + 18*k
+		fmt.Fprintf(&buf, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="%s" stroke-width="3"/>`,
+			chartRight+15, ly, chartRight+35, ly, color)
+		fmt.Fprintf(&buf, `<text x="%d" y="%d">%s</text>`, chartRight+40, ly+4, template.HTMLEscapeString(names[k]))
+	}
+
+	buf.WriteString(`</svg>`)
+
+	return template.HTML(buf.String())
+}
+
+// enrollmentCharts returns the charts of the enrollment into each group
+// and of the imbalance of the variables, in the order of enrollment.
+// Since the scoring functions have different scales, the variables
+// are shown in one chart for each scoring function.  Variables scored
+// with "IsMin" are not shown, since their imbalance is not defined.
+func enrollmentCharts(project *Project, eh *EnrollmentHistory) []template.HTML {
+
+	if eh.NumSubjects == 0 {
+		return nil
+	}
+
+	charts := []template.HTML{
+		lineChart("Cumulative enrollment", "Enrollment order", "Number of subjects",
+			project.GroupNames, eh.Enrollment),
+	}
+
+	for _, f := range imbalanceFuncs {
+		if f.Name == "IsMin" {
+			continue
+		}
+		var names []string
+		var series [][]float64
+		for j, va := range project.Variables {
+			if va.Func == f.Name {
+				names = append(names, va.Name)
+				series = append(series, eh.Imbalance[j])
+			}
+		}
+		if len(names) > 0 {
+			charts = append(charts, lineChart("Imbalance of the variables ("+f.Label+")",
+				"Enrollment order", f.Label, names, series))
+		}
+	}
+
+	return charts
+}
@@ -0,0 +1,617 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// maxCandidates is the largest number of candidate allocations that
+// are considered when randomizing clusters.  If there are more
+// possible allocations, a random sample of this size is used.
+const maxCandidates = 10000
+
+// ClusterRandomization records one constrained randomization of a set
+// of clusters.
+type ClusterRandomization struct {
+	Time     time.Time
+	Person   string
+	Clusters []string
+	Seed     int64
+
+	// The proportion of the candidate allocations, ordered by their
+	// balance, from which the allocation was selected.
+	Fraction float64
+
+	// The number of candidate allocations, and whether they are all
+	// possible allocations or a random sample.
+	NumCandidates int
+	Enumerated    bool
+
+	// The number of acceptable allocations, and the balance
+	// criterion of the selected allocation.
+	NumAcceptable int
+	Balance       float64
+}
+
+// clusterAllocation assigns each subject to the treatment group of the
+// subject's cluster, which is given as the site.
+type clusterAllocation struct{}
+
+func (clusterAllocation) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	grp, ok := project.ClusterGroups[site]
+	if !ok {
+		return -1, fmt.Errorf("The cluster '%s' has not been randomized", site)
+	}
+
+	return getIndex(project.GroupNames, grp), nil
+}
+
+// clusterAggregates returns the aggregate data and numbers of
+// clusters in each treatment group, for the clusters with the given
+// groups.
+func clusterAggregates(project *Project, groups map[string]string) ([][][]float64, []int, error) {
+
+	data := newAggregateData(project)
+	counts := make([]int, len(project.GroupNames))
+	for _, c := range project.Sites {
+		g, ok := groups[c]
+		if !ok {
+			continue
+		}
+		grp := getIndex(project.GroupNames, g)
+		if err := addCluster(project, data, project.ClusterValues[c], grp); err != nil {
+			return nil, nil, err
+		}
+		counts[grp]++
+	}
+
+	return data, counts, nil
+}
+
+// addCluster adds the values of the variables for a cluster, or for a
+// subject, to the aggregate data of group grp.
+func addCluster(project *Project, data [][][]float64, values []string, grp int) error {
+
+	for j, va := range project.Variables {
+		if err := updateVariableData(&va, data[j], values[j], grp, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// clusterBalance returns the balance criterion of an allocation of the
+// clusters, given its aggregate data.  The criterion is a weighted sum
+// over the variables.  For a categorical variable, it is the sum over
+// the levels of the range of the numbers of clusters in the groups,
+// divided by the sampling rates.  For a continuous variable, it is
+// the range of the group means divided by the overall standard
+// deviation.  Smaller values indicate better balance.
+func clusterBalance(project *Project, data [][][]float64) float64 {
+
+	balance := 0.0
+	for j, va := range project.Variables {
+		balance += va.Weight * variableBalance(&va, data[j], project.SamplingRates)
+	}
+
+	return balance
+}
+
+// variableBalance returns the unweighted contribution of one variable
+// to the balance criterion calculated by clusterBalance, given the
+// aggregate data of the variable.
+func variableBalance(va *Variable, data [][]float64, rates []float64) float64 {
+
+	if va.Type == "Continuous" {
+		means, _, mean, sd := groupMoments(data)
+		if !(sd > 0) {
+			return 0
+		}
+		for i := range means {
+			if math.IsNaN(means[i]) {
+				means[i] = mean
+			}
+		}
+		return Range(means) / sd
+	}
+
+	b := 0.0
+	adj := make([]float64, len(rates))
+	for k := range va.Levels {
+		for i := range adj {
+			adj[i] = data[k][i] / rates[i]
+		}
+		b += Range(adj)
+	}
+
+	return b
+}
+
+// clusterTargets returns the numbers of m new clusters to allocate to
+// each group, so that the total numbers of clusters are as nearly
+// proportional to the sampling rates as possible.  Ties are broken at
+// random.
+func clusterTargets(project *Project, counts []int, m int, rgen *rand.Rand) []int {
+
+	rates := project.SamplingRates
+	n := make([]int, len(counts))
+	for k := 0; k < m; k++ {
+		best := math.Inf(1)
+		var ties []int
+		for i := range n {
+			x := float64(counts[i]+n[i]+1) / rates[i]
+			switch {
+			case x < best-1e-9:
+				best = x
+				ties = []int{i}
+			case x < best+1e-9:
+				ties = append(ties, i)
+			}
+		}
+		n[ties[rgen.Intn(len(ties))]]++
+	}
+
+	return n
+}
+
+// numArrangements returns the number of distinct ways to allocate
+// clusters to groups with n[i] clusters in group i.
+func numArrangements(n []int) float64 {
+
+	m := 0
+	for _, x := range n {
+		m += x
+	}
+
+	lg, _ := math.Lgamma(float64(m + 1))
+	for _, x := range n {
+		v, _ := math.Lgamma(float64(x + 1))
+		lg -= v
+	}
+
+	return math.Exp(lg)
+}
+
+// candidateAllocations returns the candidate allocations of clusters
+// to groups with n[i] clusters in group i.  Each allocation contains
+// the group of each cluster.  If there are at most maxCandidates
+// possible allocations, all of them are returned, and the second
+// returned value is true.  Otherwise a random sample of maxCandidates
+// allocations is returned.
+func candidateAllocations(n []int, rgen *rand.Rand) ([][]int, bool) {
+
+	var base []int
+	for i, x := range n {
+		for k := 0; k < x; k++ {
+			base = append(base, i)
+		}
+	}
+	m := len(base)
+
+	if numArrangements(n) < maxCandidates+0.5 {
+		var cands [][]int
+		cur := make([]int, 0, m)
+		rem := make([]int, len(n))
+		copy(rem, n)
+		var enumerate func()
+		enumerate = func() {
+			if len(cur) == m {
+				a := make([]int, m)
+				copy(a, cur)
+				cands = append(cands, a)
+				return
+			}
+			for i := range rem {
+				if rem[i] > 0 {
+					rem[i]--
+					cur = append(cur, i)
+					enumerate()
+					cur = cur[:len(cur)-1]
+					rem[i]++
+				}
+			}
+		}
+		enumerate()
+		return cands, true
+	}
+
+	cands := make([][]int, maxCandidates)
+	for c := range cands {
+		a := make([]int, m)
+		for k, p := range rgen.Perm(m) {
+			a[k] = base[p]
+		}
+		cands[c] = a
+	}
+
+	return cands, false
+}
+
+// acceptableAllocations returns the positions of the candidate
+// allocations whose balance criterion is at least as good as that of
+// the allocation at the given fraction of the ranked candidates.
+func acceptableAllocations(scores []float64, fraction float64) []int {
+
+	sorted := make([]float64, len(scores))
+	copy(sorted, scores)
+	sort.Float64s(sorted)
+	na := int(math.Ceil(fraction * float64(len(scores))))
+	if na < 1 {
+		na = 1
+	}
+	cutoff := sorted[na-1]
+
+	var acceptable []int
+	for c, s := range scores {
+		if s <= cutoff {
+			acceptable = append(acceptable, c)
+		}
+	}
+
+	return acceptable
+}
+
+// randomizeClusters allocates the given clusters to treatment groups
+// by constrained randomization, using a random number generator with
+// the given seed.  The candidate allocations are ranked by the balance
+// of the variables over all randomized clusters, and one allocation is
+// selected at random from the given fraction of the candidates with
+// the best balance.
+func randomizeClusters(project *Project, clusters []string, fraction float64, seed int64) (*ClusterRandomization, error) {
+
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no clusters were selected")
+	}
+	if fraction <= 0 || fraction > 1 {
+		return nil, fmt.Errorf("the acceptable fraction must be greater than 0 and no greater than 1")
+	}
+	for _, c := range clusters {
+		if getIndex(project.Sites, c) == -1 {
+			return nil, fmt.Errorf("'%s' is not a cluster of this project", c)
+		}
+		if _, ok := project.ClusterGroups[c]; ok {
+			return nil, fmt.Errorf("the cluster '%s' has already been randomized", c)
+		}
+		values := project.ClusterValues[c]
+		if len(values) != len(project.Variables) {
+			return nil, fmt.Errorf("the values of the variables have not been entered for cluster '%s'", c)
+		}
+		for j, va := range project.Variables {
+			if err := checkValue(&va, values[j]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	rgen := rand.New(rand.NewSource(seed))
+
+	data, counts, err := clusterAggregates(project, project.ClusterGroups)
+	if err != nil {
+		return nil, err
+	}
+
+	n := clusterTargets(project, counts, len(clusters), rgen)
+	cands, enumerated := candidateAllocations(n, rgen)
+
+	scores := make([]float64, len(cands))
+	for c, a := range cands {
+		d := newAggregateData(project)
+		for j := range data {
+			for k := range data[j] {
+				copy(d[j][k], data[j][k])
+			}
+		}
+		for k, grp := range a {
+			if err := addCluster(project, d, project.ClusterValues[clusters[k]], grp); err != nil {
+				return nil, err
+			}
+		}
+		scores[c] = clusterBalance(project, d)
+	}
+
+	acceptable := acceptableAllocations(scores, fraction)
+	sel := acceptable[rgen.Intn(len(acceptable))]
+	for k, grp := range cands[sel] {
+		project.ClusterGroups[clusters[k]] = project.GroupNames[grp]
+	}
+
+	cr := &ClusterRandomization{
+		Time:          time.Now(),
+		Clusters:      clusters,
+		Seed:          seed,
+		Fraction:      fraction,
+		NumCandidates: len(cands),
+		Enumerated:    enumerated,
+		NumAcceptable: len(acceptable),
+		Balance:       scores[sel],
+	}
+	project.ClusterRandomizations = append(project.ClusterRandomizations, cr)
+
+	return cr, nil
+}
+
+// ClusterRow contains the information about one cluster that is
+// displayed on the clusters page.
+type ClusterRow struct {
+	Name  string
+	Index int
+	Group string
+	Cells []*ClusterCell
+}
+
+// ClusterCell is the value of one variable for a cluster, with the
+// information needed to edit it.
+type ClusterCell struct {
+	Field      string
+	Value      string
+	Levels     []string
+	Continuous bool
+}
+
+// getClusterProject loads a project for managing its clusters.  If
+// the project cannot be loaded, the user is not the owner, or the
+// project does not use cluster randomization, a message is displayed
+// and nil is returned.
+func getClusterProject(w http.ResponseWriter, r *http.Request, pkey string) *Project {
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "getClusterProject: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return nil
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage its clusters."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	if project.Method != "Cluster" {
+		msg := "This project does not use cluster randomization."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	return project
+}
+
+// clustersPage displays the clusters of a project, with forms to
+// enter the values of their variables and to randomize them.
+func clustersPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getClusterProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	var rows, pending []*ClusterRow
+	for i, c := range project.Sites {
+		row := &ClusterRow{Name: c, Index: i, Group: project.ClusterGroups[c]}
+		values := project.ClusterValues[c]
+		for j, va := range project.Variables {
+			cell := &ClusterCell{
+				Field:      fmt.Sprintf("value%d_%d", i, j),
+				Levels:     va.Levels,
+				Continuous: va.Type == "Continuous",
+			}
+			if j < len(values) {
+				cell.Value = values[j]
+			}
+			row.Cells = append(row.Cells, cell)
+		}
+		rows = append(rows, row)
+		if row.Group == "" {
+			pending = append(pending, row)
+		}
+	}
+
+	data, counts, err := clusterAggregates(project, project.ClusterGroups)
+	if err != nil {
+		log.Errorf(ctx, "clustersPage: %v", err)
+	}
+	var balance [][]string
+	if err == nil {
+		row := make([]string, 1+len(counts))
+		row[0] = "All clusters"
+		for q, n := range counts {
+			row[q+1] = fmt.Sprintf("%d", n)
+		}
+		balance = append([][]string{row}, levelStats(project, data, counts, "")...)
+	}
+
+	tvals := struct {
+		User           string
+		LoggedIn       bool
+		ProjectName    string
+		Pkey           string
+		Variables      []Variable
+		GroupNames     []string
+		Clusters       []*ClusterRow
+		Pending        []*ClusterRow
+		Balance        [][]string
+		Randomizations []*ClusterRandomization
+		MaxCandidates  int
+	}{
+		User:           user.String(),
+		LoggedIn:       user != nil,
+		ProjectName:    project.Name,
+		Pkey:           pkey,
+		Variables:      project.Variables,
+		GroupNames:     project.GroupNames,
+		Clusters:       rows,
+		Pending:        pending,
+		Balance:        balance,
+		Randomizations: project.ClusterRandomizations,
+		MaxCandidates:  maxCandidates,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "clusters.html", tvals); err != nil {
+		log.Errorf(ctx, "clustersPage failed to execute template: %v", err)
+	}
+}
+
+// clusterValues stores the values of the variables for the clusters
+// that have not been randomized.
+func clusterValues(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+
+	project := getClusterProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	for i, c := range project.Sites {
+		if _, ok := project.ClusterGroups[c]; ok {
+			continue
+		}
+		values := make([]string, len(project.Variables))
+		for j, va := range project.Variables {
+			x := strings.TrimSpace(r.FormValue(fmt.Sprintf("value%d_%d", i, j)))
+			if x != "" {
+				if err := checkValue(&va, x); err != nil {
+					msg := fmt.Sprintf("The values were not stored: %v for cluster '%s'.", err, c)
+					rmsg := "Return to clusters"
+					messagePage(w, r, user, msg, rmsg, "/clusters?pkey="+pkey)
+					return
+				}
+			}
+			values[j] = x
+		}
+		project.ClusterValues[c] = values
+	}
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "clusterValues: %v", err)
+		msg := "A datastore error occured, the values were not stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := "The values of the variables for the clusters have been stored."
+	rmsg := "Return to clusters"
+	messagePage(w, r, user, msg, rmsg, "/clusters?pkey="+pkey)
+}
+
+// randomizeClustersPage randomizes the selected clusters, and records
+// the randomization as a comment.
+func randomizeClustersPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+
+	project := getClusterProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	var clusters []string
+	for i, c := range project.Sites {
+		if r.FormValue(fmt.Sprintf("randomize%d", i)) == "yes" {
+			clusters = append(clusters, c)
+		}
+	}
+
+	fraction, err := strconv.ParseFloat(strings.TrimSpace(r.FormValue("fraction")), 64)
+	if err != nil {
+		fraction = -1
+	}
+
+	seed, err := newSeed()
+	if err != nil {
+		log.Errorf(ctx, "randomizeClustersPage: %v", err)
+		msg := "The clusters were not randomized, a random seed could not be obtained."
+		rmsg := "Return to clusters"
+		messagePage(w, r, user, msg, rmsg, "/clusters?pkey="+pkey)
+		return
+	}
+
+	cr, err := randomizeClusters(project, clusters, fraction, seed)
+	if err != nil {
+		msg := fmt.Sprintf("The clusters were not randomized: %v.", err)
+		rmsg := "Return to clusters"
+		messagePage(w, r, user, msg, rmsg, "/clusters?pkey="+pkey)
+		return
+	}
+	cr.Person = user.String()
+
+	var groups []string
+	for _, c := range clusters {
+		groups = append(groups, c+": "+project.ClusterGroups[c])
+	}
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{
+		fmt.Sprintf("Clusters randomized (%s).", strings.Join(groups, ", ")),
+		fmt.Sprintf("The allocation was selected from %d acceptable allocations out of %d candidates.", cr.NumAcceptable, cr.NumCandidates),
+	}
+	project.Comments = append(project.Comments, comment)
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "randomizeClustersPage: %v", err)
+		msg := "A datastore error occured, the clusters were not randomized."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The clusters have been randomized: %s.", strings.Join(groups, ", "))
+	rmsg := "Return to clusters"
+	messagePage(w, r, user, msg, rmsg, "/clusters?pkey="+pkey)
+}
@@ -0,0 +1,111 @@
+package randomization
+
+import (
+	"math"
+)
+
+// groupMoments returns the mean and standard deviation of a continuous
+// variable within each treatment group, and overall.  The aggregate
+// data `stats` contain the count, sum and sum of squares of the values
+// in each group.  The mean and standard deviation of a group with no
+// subjects are NaN, the standard deviation of a group with one subject
+// is zero.
+func groupMoments(stats [][]float64) ([]float64, []float64, float64, float64) {
+
+	numGroups := len(stats[0])
+	means := make([]float64, numGroups)
+	sds := make([]float64, numGroups)
+
+	var n, sum, sumsq float64
+	for i := 0; i < numGroups; i++ {
+		means[i], sds[i] = moments(stats[0][i], stats[1][i], stats[2][i])
+		n += stats[0][i]
+		sum += stats[1][i]
+		sumsq += stats[2][i]
+	}
+	mean, sd := moments(n, sum, sumsq)
+
+	return means, sds, mean, sd
+}
+
+// moments returns the mean and standard deviation of n values with the
+// given sum and sum of squares.
+func moments(n, sum, sumsq float64) (float64, float64) {
+
+	if n == 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	mean := sum / n
+	if n == 1 {
+		return mean, 0
+	}
+
+	v := (sumsq - n*mean*mean) / (n - 1)
+	if v < 0 {
+		// Rounding error
+		v = 0
+	}
+
+	return mean, math.Sqrt(v)
+}
+
+// continuousScore calculates the contribution to the overall score of a
+// continuous variable `va` if we put a subject with value `x` into group
+// `grp`.  The aggregate data `stats` contain the count, sum and sum of
+// squares of the values in each group.
+//
+// The "StdMean" function is the standardized mean difference, i.e. the
+// range of the group means divided by the overall standard deviation.
+// The "StdMeanVar" function adds to this the range of the logarithms
+// of the group standard deviations, so that the spread of the values
+// is also balanced.  Groups without subjects are taken to have the
+// overall mean, and groups with fewer than two subjects are not used
+// when balancing the standard deviations.
+func continuousScore(x float64, grp int, stats [][]float64, va *Variable) float64 {
+
+	numGroups := len(stats[0])
+
+	newStats := make([][]float64, 3)
+	for k := range newStats {
+		newStats[k] = make([]float64, numGroups)
+		copy(newStats[k], stats[k])
+	}
+	newStats[0][grp]++
+	newStats[1][grp] += x
+	newStats[2][grp] += x * x
+
+	return continuousImbalance(newStats, va)
+}
+
+// continuousImbalance returns the imbalance of a continuous variable
+// `va` under its scoring function, given the aggregate data `stats`
+// of the subjects in each group.
+func continuousImbalance(stats [][]float64, va *Variable) float64 {
+
+	means, sds, mean, sd := groupMoments(stats)
+	if sd == 0 {
+		return 0
+	}
+
+	for i := range means {
+		if math.IsNaN(means[i]) {
+			means[i] = mean
+		}
+	}
+	score := Range(means) / sd
+
+	if va.Func == "StdMeanVar" {
+		var logsd []float64
+		for i, s := range sds {
+			if stats[0][i] >= 2 && s > 0 {
+				logsd = append(logsd, math.Log(s))
+			}
+		}
+		if len(logsd) > 1 {
+			score += Range(logsd)
+		}
+	}
+
+	return score
+}
@@ -6,7 +6,6 @@ import (
 	"strings"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -31,9 +30,7 @@ func copyProject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	var eproj EncodedProject
-	err := datastore.Get(ctx, key, &eproj)
+	eproj, err := repository.GetProject(ctx, pkey)
 	if err != nil {
 		log.Errorf(ctx, "Copy_project: %v", err)
 		msg := "Unknown datastore error."
@@ -79,9 +76,7 @@ func copyProjectCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	var eproj EncodedProject
-	err := datastore.Get(ctx, key, &eproj)
+	eproj, err := repository.GetProject(ctx, pkey)
 	if err != nil {
 		msg := "Unknown error, the project was not copied."
 		rmsg := "Return to dashboard"
@@ -90,7 +85,7 @@ func copyProjectCompleted(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	eprojCopy := copyEncodedProject(&eproj)
+	eprojCopy := copyEncodedProject(eproj)
 
 	// Check if the name is valid (not blank)
 	newName := r.FormValue("new_project_name")
@@ -108,17 +103,14 @@ func copyProjectCompleted(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the project name has already been used.
 	newPkey := user.String() + "::" + newName
-	newKey := datastore.NewKey(ctx, "EncodedProject", newPkey, 0, nil)
-	var pr EncodedProject
-	err = datastore.Get(ctx, newKey, &pr)
-	if err == nil {
+	if projectExists(ctx, newPkey) {
 		msg := fmt.Sprintf("A project named \"%s\" belonging to user %s already exists.", newName, user.String())
 		rmsg := "Return to dashboard"
 		messagePage(w, r, user, msg, rmsg, "/dashboard")
 		return
 	}
 
-	_, err = datastore.Put(ctx, newKey, eprojCopy)
+	err = repository.PutProject(ctx, newPkey, eprojCopy)
 	if err != nil {
 		log.Errorf(ctx, "Copy_project: %v", err)
 		msg := "Unknown error, the project was not copied."
@@ -8,7 +8,6 @@ import (
 	"time"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -57,10 +56,7 @@ func createProjectStep2(w http.ResponseWriter, r *http.Request) {
 
 	// Check if the project name has already been used.
 	pkey := user.String() + "::" + projectName
-	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	var pr EncodedProject
-	err := datastore.Get(ctx, key, &pr)
-	if err == nil {
+	if projectExists(ctx, pkey) {
 		msg := fmt.Sprintf("A project named \"%s\" belonging to user %s already exists.", projectName, user.String())
 		rmsg := "Return to dashboard"
 		messagePage(w, r, user, msg, rmsg, "/dashboard")
@@ -83,7 +79,8 @@ func createProjectStep2(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// createProjectStep3 gets the number of treatment groups.
+// createProjectStep3 gets the number of treatment groups and the
+// allocation method.
 func createProjectStep3(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "POST" {
@@ -106,11 +103,13 @@ func createProjectStep3(w http.ResponseWriter, r *http.Request) {
 		Name         string
 		Pkey         string
 		StoreRawData bool
+		Methods      []*AllocationMethod
 	}{
 		User:         user.String(),
 		LoggedIn:     user != nil,
 		Name:         r.FormValue("project_name"),
 		StoreRawData: r.FormValue("store_rawdata") == "yes",
+		Methods:      allocationMethods,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step3.html", tvals); err != nil {
@@ -133,6 +132,13 @@ func createProjectStep4(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The group names of a factorial design are determined by the
+	// factors, so they are not entered.
+	if strings.TrimSpace(r.FormValue("factors")) != "" {
+		createProjectStep5(w, r)
+		return
+	}
+
 	user := user.Current(ctx)
 
 	numgroups, _ := strconv.Atoi(r.FormValue("numgroups"))
@@ -151,6 +157,7 @@ func createProjectStep4(w http.ResponseWriter, r *http.Request) {
 		StoreRawData bool
 		NumGroups    int
 		IX           []int
+		Method       string
 	}{
 		User:         user.String(),
 		LoggedIn:     user != nil,
@@ -158,6 +165,7 @@ func createProjectStep4(w http.ResponseWriter, r *http.Request) {
 		StoreRawData: r.FormValue("store_rawdata") == "true",
 		IX:           IX,
 		NumGroups:    numgroups,
+		Method:       r.FormValue("method"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step4.html", tvals); err != nil {
@@ -184,18 +192,32 @@ func createProjectStep5(w http.ResponseWriter, r *http.Request) {
 
 	numgroups, _ := strconv.Atoi(r.FormValue("numgroups"))
 
+	// Get the group names from the previous page, or from the
+	// factors of a factorial design.
+	var GroupNames []string
+	if factors := r.FormValue("factors"); strings.TrimSpace(factors) != "" {
+		fa, err := parseFactors(factors)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to create the project: %v", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+		GroupNames = factorCells(fa)
+		numgroups = len(GroupNames)
+	} else {
+		GroupNames = make([]string, numgroups)
+		for i := 0; i < numgroups; i++ {
+			GroupNames[i] = r.FormValue(fmt.Sprintf("name%d", i+1))
+		}
+	}
+
 	// Indices for the groups
 	ix := make([]int, numgroups)
 	for i := 0; i < numgroups; i++ {
 		ix[i] = i
 	}
 
-	// Get the group names from the previous page
-	GroupNames := make([]string, numgroups)
-	for i := 0; i < numgroups; i++ {
-		GroupNames[i] = r.FormValue(fmt.Sprintf("name%d", i+1))
-	}
-
 	tvals := struct {
 		User           string
 		LoggedIn       bool
@@ -206,6 +228,8 @@ func createProjectStep5(w http.ResponseWriter, r *http.Request) {
 		StoreRawData   bool
 		NumGroups      int
 		IX             []int
+		Method         string
+		Factors        string
 	}{
 		User:           user.String(),
 		LoggedIn:       user != nil,
@@ -215,6 +239,8 @@ func createProjectStep5(w http.ResponseWriter, r *http.Request) {
 		NumGroups:      len(GroupNames),
 		StoreRawData:   r.FormValue("store_rawdata") == "true",
 		IX:             ix,
+		Method:         r.FormValue("method"),
+		Factors:        r.FormValue("factors"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step5.html", tvals); err != nil {
@@ -276,6 +302,8 @@ func createProjectStep6(w http.ResponseWriter, r *http.Request) {
 		StoreRawData  bool
 		SamplingRates string
 		NumGroups     int
+		Method        string
+		Factors       string
 	}{
 		User:          user.String(),
 		LoggedIn:      user != nil,
@@ -284,6 +312,8 @@ func createProjectStep6(w http.ResponseWriter, r *http.Request) {
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: strings.Join(samplingRates, ","),
 		NumGroups:     numgroups,
+		Method:        r.FormValue("method"),
+		Factors:       r.FormValue("factors"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step6.html", tvals); err != nil {
@@ -329,6 +359,10 @@ func createProjectStep7(w http.ResponseWriter, r *http.Request) {
 		NumVar        int
 		Any_vars      bool
 		SamplingRates string
+		Method        string
+		Factors       string
+		Sites         string
+		Funcs         []*ImbalanceFunc
 	}{
 		User:          user.String(),
 		LoggedIn:      user != nil,
@@ -340,6 +374,10 @@ func createProjectStep7(w http.ResponseWriter, r *http.Request) {
 		Any_vars:      numvar > 0,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Method:        r.FormValue("method"),
+		Factors:       r.FormValue("factors"),
+		Sites:         r.FormValue("sites"),
+		Funcs:         imbalanceFuncs,
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step7.html", tvals); err != nil {
@@ -352,7 +390,7 @@ func processVariableInfo(r *http.Request, numvar int) (string, bool) {
 	variables := make([]string, numvar)
 
 	for i := 0; i < numvar; i++ {
-		vec := make([]string, 4)
+		vec := make([]string, 6)
 
 		vname := fmt.Sprintf("name%d", i+1)
 		vec[0] = strings.TrimSpace(r.FormValue(vname))
@@ -360,6 +398,25 @@ func processVariableInfo(r *http.Request, numvar int) (string, bool) {
 			return "", false
 		}
 
+		vec[2] = r.FormValue(fmt.Sprintf("weight%d", i+1))
+		vec[3] = r.FormValue(fmt.Sprintf("func%d", i+1))
+		vec[4] = r.FormValue(fmt.Sprintf("type%d", i+1))
+		vec[5] = "no"
+		if r.FormValue(fmt.Sprintf("missing%d", i+1)) == "yes" {
+			vec[5] = "yes"
+		}
+
+		f, err := getImbalanceFunc(vec[3])
+		if err != nil || f.Continuous != (vec[4] == "Continuous") {
+			return "", false
+		}
+
+		// Continuous variables have no levels
+		if f.Continuous {
+			variables[i] = strings.Join(vec, ";")
+			continue
+		}
+
 		vname = fmt.Sprintf("levels%d", i+1)
 		vec[1] = r.FormValue(vname)
 		levels := cleanSplit(vec[1], ",")
@@ -372,8 +429,6 @@ func processVariableInfo(r *http.Request, numvar int) (string, bool) {
 			}
 		}
 
-		vec[2] = r.FormValue(fmt.Sprintf("weight%d", i+1))
-		vec[3] = r.FormValue(fmt.Sprintf("func%d", i+1))
 		variables[i] = strings.Join(vec, ";")
 	}
 
@@ -429,6 +484,9 @@ func createProjectStep8(w http.ResponseWriter, r *http.Request) {
 		Numvar        int
 		Variables     string
 		SamplingRates string
+		Method        string
+		Factors       string
+		Sites         string
 	}{
 		User:          user.String(),
 		LoggedIn:      user != nil,
@@ -440,6 +498,9 @@ func createProjectStep8(w http.ResponseWriter, r *http.Request) {
 		Variables:     variables,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Method:        r.FormValue("method"),
+		Factors:       r.FormValue("factors"),
+		Sites:         r.FormValue("sites"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step8.html", tvals); err != nil {
@@ -475,9 +536,22 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 	variables := r.FormValue("variables")
 	VL := cleanSplit(variables, ":")
 
-	bias, err := strconv.Atoi(r.FormValue("bias"))
-	if err != nil {
+	method := r.FormValue("method")
+	if _, err := getAllocationMethod(method); err != nil {
 		log.Errorf(ctx, "createProjectStep9: %v", err)
+		msg := "Unable to create the project, the allocation method is not valid."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	// The bias is only used by minimization.
+	var bias int
+	if method == "Minimization" {
+		bias, err = strconv.Atoi(r.FormValue("bias"))
+		if err != nil {
+			log.Errorf(ctx, "createProjectStep9: %v", err)
+		}
 	}
 
 	// Parse and validate the variable information.
@@ -494,6 +568,11 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 		}
 
 		va.Func = vx[3]
+		va.Type = vx[4]
+		if va.Type == "Continuous" {
+			va.Levels = nil
+		}
+		va.AllowMissing = vx[5] == "yes"
 		VA[i] = va
 	}
 
@@ -503,11 +582,23 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 	project.Name = projectName
 	project.Variables = VA
 	project.Bias = bias
+	project.Method = method
 	project.GroupNames = cleanSplit(GroupNames, ",")
 	project.Assignments = make([]int, len(project.GroupNames))
 	project.StoreRawData = r.FormValue("store_rawdata") == "true"
 	project.Open = true
 
+	project.Factors, err = parseFactors(r.FormValue("factors"))
+	if err == nil && len(project.Factors) > 0 && strings.Join(factorCells(project.Factors), ",") != strings.Join(project.GroupNames, ",") {
+		err = fmt.Errorf("the treatment groups do not match the factors.")
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create the project: %v", err)
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
 	// Convert the rates to numbers
 	rates := r.FormValue("rates")
 	ratesArr := cleanSplit(rates, ",")
@@ -520,24 +611,175 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 	}
 	project.SamplingRates = ratesNum
 
-	// Set up the data.
-	numgroups := len(project.GroupNames)
-	data0 := make([][][]float64, len(project.Variables))
-	for j, va := range project.Variables {
-		data0[j] = make([][]float64, len(va.Levels))
-		for k := range va.Levels {
-			data0[j][k] = make([]float64, numgroups)
+	if method == "Blocks" || method == "StratifiedBlocks" {
+		project.BlockSizes, err = parseBlockSizes(r.FormValue("block_sizes"), ratesNum)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to create the project: %v", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
+	if method == "BiasedCoin" || method == "BigStick" {
+		if len(project.GroupNames) != 2 {
+			msg := "Unable to create the project: the biased coin and big stick designs can only be used with two treatment groups."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
 		}
 	}
-	project.Data = data0
+
+	if method == "BiasedCoin" {
+		project.CoinProb, err = strconv.ParseFloat(r.FormValue("coin_prob"), 64)
+		if err != nil || project.CoinProb <= 0.5 || project.CoinProb > 1 {
+			msg := "Unable to create the project: the biased coin probability must be a number greater than 0.5 and no greater than 1."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
+	if method == "BigStick" {
+		project.MaxImbalance, err = strconv.Atoi(r.FormValue("max_imbalance"))
+		if err != nil || project.MaxImbalance < 1 {
+			msg := "Unable to create the project: the maximum imbalance must be a positive whole number."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
+	if method == "Minimization" {
+		project.MaxImbalance, err = parseMaxImbalance(r.FormValue("max_imbalance"))
+		if err == nil {
+			project.LevelMaxImbalance, err = parseMaxImbalance(r.FormValue("level_max_imbalance"))
+		}
+		if err != nil {
+			msg := "Unable to create the project: the maximum imbalance must be blank or a positive whole number."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+
+		if x := strings.TrimSpace(r.FormValue("overall_weight")); x != "" {
+			project.OverallWeight, err = strconv.ParseFloat(x, 64)
+			if err != nil || project.OverallWeight < 0 {
+				msg := "Unable to create the project: the overall balance weight must be blank or a non-negative number."
+				rmsg := "Return to dashboard"
+				messagePage(w, r, user, msg, rmsg, "/dashboard")
+				return
+			}
+		}
+	}
+
+	if method == "Thompson" || method == "PlayTheWinner" {
+		if !project.StoreRawData {
+			msg := "Unable to create the project: complete data must be stored when using response-adaptive allocation, so that the outcomes can be recorded."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+
+		project.OutcomeType = r.FormValue("outcome_type")
+		if project.OutcomeType != "Binary" && !(method == "Thompson" && project.OutcomeType == "Continuous") {
+			msg := "Unable to create the project: the outcome type is not valid."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+		project.SmallerBetter = r.FormValue("smaller_better") == "yes"
+		project.OutcomeStats = newOutcomeStats(&project)
+
+		if x := strings.TrimSpace(r.FormValue("burn_in")); x != "" {
+			project.BurnIn, err = strconv.Atoi(x)
+			if err != nil || project.BurnIn < 0 {
+				msg := "Unable to create the project: the burn-in size must be blank or a non-negative whole number."
+				rmsg := "Return to dashboard"
+				messagePage(w, r, user, msg, rmsg, "/dashboard")
+				return
+			}
+		}
+
+		project.MinProb, project.MaxProb, err = parseProbLimits(r.FormValue("min_prob"), r.FormValue("max_prob"), len(project.GroupNames))
+		if err != nil {
+			msg := fmt.Sprintf("Unable to create the project: %v", err)
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+	}
+
+	if method == "StratifiedBlocks" {
+		for _, va := range project.Variables {
+			if va.Type == "Continuous" {
+				msg := "Unable to create the project: continuous variables cannot be used to define strata."
+				rmsg := "Return to dashboard"
+				messagePage(w, r, user, msg, rmsg, "/dashboard")
+				return
+			}
+			if va.AllowMissing {
+				msg := "Unable to create the project: variables that are used to define strata cannot have missing values."
+				rmsg := "Return to dashboard"
+				messagePage(w, r, user, msg, rmsg, "/dashboard")
+				return
+			}
+		}
+		project.StratumAssignments = make(map[string][]int)
+		if x := strings.TrimSpace(r.FormValue("planned_size")); x != "" {
+			project.PlannedSize, err = strconv.Atoi(x)
+			if err != nil || project.PlannedSize < 0 {
+				msg := "Unable to create the project: the planned sample size must be blank or a non-negative whole number."
+				rmsg := "Return to dashboard"
+				messagePage(w, r, user, msg, rmsg, "/dashboard")
+				return
+			}
+		}
+	}
+
+	project.Sites, err = parseSites(r.FormValue("sites"))
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create the project: %v", err)
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+	if method == "Cluster" {
+		if len(project.Sites) < 2 {
+			msg := "Unable to create the project: the clusters must be entered as the sites of the project, and there must be at least two clusters."
+			rmsg := "Return to dashboard"
+			messagePage(w, r, user, msg, rmsg, "/dashboard")
+			return
+		}
+		project.ClusterValues = make(map[string][]string)
+		project.ClusterGroups = make(map[string]string)
+	}
+	if len(project.Sites) > 0 {
+		project.SiteData = make(map[string][][][]float64)
+		project.SiteAssignments = make(map[string][]int)
+		project.UserSites = make(map[string]string)
+		if method == "Minimization" {
+			if x := strings.TrimSpace(r.FormValue("global_weight")); x != "" {
+				project.GlobalWeight, err = strconv.ParseFloat(x, 64)
+				if err != nil || project.GlobalWeight < 0 {
+					msg := "Unable to create the project: the global balance weight must be blank or a non-negative number."
+					rmsg := "Return to dashboard"
+					messagePage(w, r, user, msg, rmsg, "/dashboard")
+					return
+				}
+			}
+		}
+	}
+
+	// Set up the data.
+	project.Data = newAggregateData(&project)
 
 	pkey := user.String() + "::" + projectName
-	dkey := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
 	eproj, err := encodeProject(&project)
 	if err != nil {
 		log.Errorf(ctx, "Create_project_step9 [2]: %v", err)
 	}
-	_, err = datastore.Put(ctx, dkey, eproj)
+	err = repository.PutProject(ctx, pkey, eproj)
 	if err != nil {
 		msg := "A datastore error occured, the project was not created."
 		log.Errorf(ctx, "Create_project_step9: %v", err)
@@ -546,9 +788,9 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Remove any stale SharingByProject entities
-	dkey = datastore.NewKey(ctx, "SharingByProject", pkey, 0, nil)
-	err = datastore.Delete(ctx, dkey)
+	// Remove any stale sharing of an earlier project with the
+	// same name
+	err = repository.DeleteSharing(ctx, pkey)
 	if err != nil {
 		log.Errorf(ctx, "Create_project_step9 [3]: %v", err)
 	}
@@ -556,9 +798,11 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 	tvals := struct {
 		User     string
 		LoggedIn bool
+		Warning  string
 	}{
 		User:     user.String(),
 		LoggedIn: user != nil,
+		Warning:  strataWarning(&project),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "create_project_step9.html", tvals); err != nil {
@@ -566,6 +810,55 @@ func createProjectStep9(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// parseMaxImbalance converts an optional maximum tolerated imbalance
+// to a number, a blank value corresponds to no limit (zero).
+func parseMaxImbalance(s string) (int, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	x, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if x < 1 {
+		return 0, fmt.Errorf("Invalid maximum imbalance %d", x)
+	}
+
+	return x, nil
+}
+
+// parseProbLimits converts the optional smallest and largest
+// assignment probabilities to numbers, and checks that they can be
+// satisfied by the given number of groups.  Blank values are
+// converted to zero, meaning that there is no limit.
+func parseProbLimits(lo, hi string, numGroups int) (float64, float64, error) {
+
+	var x [2]float64
+	for i, s := range []string{lo, hi} {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || v > 1 {
+			return 0, 0, fmt.Errorf("the assignment probabilities must be blank or between 0 and 1.")
+		}
+		x[i] = v
+	}
+
+	if x[0]*float64(numGroups) > 1 {
+		return 0, 0, fmt.Errorf("the smallest assignment probability is too large for %d treatment groups.", numGroups)
+	}
+	if x[1] > 0 && x[1]*float64(numGroups) < 1 {
+		return 0, 0, fmt.Errorf("the largest assignment probability is too small for %d treatment groups.", numGroups)
+	}
+
+	return x[0], x[1], nil
+}
+
 func validationErrorStep8(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != "POST" {
@@ -602,6 +895,9 @@ func validationErrorStep8(w http.ResponseWriter, r *http.Request) {
 		StoreRawData  bool
 		Numvar        int
 		SamplingRates string
+		Method        string
+		Factors       string
+		Sites         string
 	}{
 		User:          user.String(),
 		LoggedIn:      user != nil,
@@ -611,6 +907,9 @@ func validationErrorStep8(w http.ResponseWriter, r *http.Request) {
 		Numvar:        numvar,
 		StoreRawData:  r.FormValue("store_rawdata") == "true",
 		SamplingRates: r.FormValue("rates"),
+		Method:        r.FormValue("method"),
+		Factors:       r.FormValue("factors"),
+		Sites:         r.FormValue("sites"),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "validation_error_step8.html", tvals); err != nil {
@@ -5,13 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -25,6 +25,83 @@ type DataRecord struct {
 	Included      bool
 	Data          []string
 	Assigner      string
+
+	// The site at which the subject was enrolled, blank if the
+	// project has no sites.
+	Site string
+
+	// The seed of the random number generator used for the
+	// assignment, zero for subjects assigned before the seeds were
+	// recorded.
+	Seed int64
+
+	// The probability of each treatment group at the time of the
+	// assignment, in the order of Project.GroupNames.  Nil if the
+	// allocation method does not report the probabilities, for
+	// subjects assigned in a batch, and for subjects assigned before
+	// the probabilities were recorded.
+	Probs []float64
+
+	// The changes of the treatment group made after the
+	// assignment, in the order that they were made.
+	Edits []GroupEdit
+
+	// The outcome of the subject, used by response-adaptive
+	// allocation methods.  HasOutcome is false until the outcome has
+	// been recorded.
+	HasOutcome  bool
+	Outcome     float64
+	OutcomeTime time.Time
+
+	// The missing values that were filled in after the assignment,
+	// in the order that they were filled in.
+	Fills []ValueFill
+
+	// The time at which the subject was removed from the project,
+	// zero if the subject has not been removed, or if the removal
+	// time was not recorded.
+	RemovedTime time.Time
+
+	// The assignments of the subject in the later stages of a
+	// sequential multiple assignment design, in the order of the
+	// stages.
+	StageAssignments []*StageAssignment
+
+	// The position plus one within Project.Batches of the batch in
+	// which the subject was assigned, zero if the subject was
+	// assigned individually.
+	Batch int
+}
+
+// StageAssignment records the assignment of a subject in a later
+// stage of a sequential multiple assignment design.
+type StageAssignment struct {
+	// The position of the stage within Project.Stages.
+	Stage int
+
+	Time     time.Time
+	Group    string
+	Data     []string
+	Seed     int64
+	Assigner string
+
+	// The probability of each group of the stage at the time of the
+	// assignment, in the order of Stage.GroupNames.
+	Probs []float64
+}
+
+// ValueFill records a missing value of a variable that was filled in
+// after the assignment.
+type ValueFill struct {
+	Time     time.Time
+	Variable string
+	Value    string
+}
+
+// GroupEdit records a change of a subject's treatment group.
+type GroupEdit struct {
+	Time  time.Time
+	Group string
 }
 
 // Project stores all information about one project.
@@ -67,28 +144,195 @@ type Project struct {
 
 	// The sampling rates for each treatment group.
 	SamplingRates []float64
+
+	// The name of the method used to make the group assignments,
+	// see allocationMethods.
+	Method string
+
+	// The possible sizes of the permuted blocks, only used with
+	// block randomization.
+	BlockSizes []int
+
+	// The current permuted block, keyed by stratum.  If the blocks
+	// are not stratified, the only key is the empty string.
+	Blocks map[string]*Block
+
+	// The number of subjects assigned to each group within each
+	// stratum, only used with stratified block randomization.  The
+	// strata are keyed as in stratumKey.
+	StratumAssignments map[string][]int
+
+	// The planned total number of subjects, zero if unknown.
+	PlannedSize int
+
+	// The probability of assigning a subject to the
+	// under-represented group, only used with the biased coin
+	// design.
+	CoinProb float64
+
+	// The maximum tolerated imbalance between the treatment groups,
+	// used with the big stick design and optionally with
+	// minimization.  Zero means that there is no limit.
+	MaxImbalance int
+
+	// The maximum tolerated imbalance between the treatment groups
+	// within any level of a variable, optionally used with
+	// minimization.  Zero means that there is no limit.
+	LevelMaxImbalance int
+
+	// The weight given to the balance of the overall numbers of
+	// subjects in the treatment groups by minimization.  If zero,
+	// only the balance within the levels of the variables is
+	// considered.
+	OverallWeight float64
+
+	// The sites of a multi-center trial.  If there are no sites,
+	// all subjects are treated as belonging to one site.
+	Sites []string
+
+	// The weight given to the balance over all sites, relative to
+	// the balance within the subject's site, when using
+	// minimization with sites.
+	GlobalWeight float64
+
+	// The aggregate data and numbers of subjects assigned to each
+	// group within each site, structured as Data and Assignments.
+	SiteData        map[string][][][]float64
+	SiteAssignments map[string][]int
+
+	// The default site of each user who enrolls subjects.
+	UserSites map[string]string
+
+	// The pre-generated randomization list, only used with the
+	// randomization list method.
+	List []*ListEntry
+
+	// The type of outcome used by response-adaptive allocation,
+	// either "Binary" or "Continuous".  Blank if outcomes are not
+	// recorded.
+	OutcomeType string
+
+	// If true, smaller outcomes are better, otherwise larger
+	// outcomes are better.
+	SmallerBetter bool
+
+	// The number of subjects that are assigned using the sampling
+	// rates before response-adaptive allocation starts.
+	BurnIn int
+
+	// The smallest and largest allowed assignment probabilities
+	// for response-adaptive allocation, zero if there is no limit.
+	MinProb float64
+	MaxProb float64
+
+	// The number of recorded outcomes, their sum, and their sum of
+	// squares (rows) within each group (columns).
+	OutcomeStats [][]float64
+
+	// The treatment factors of a factorial design.  The treatment
+	// groups are then all combinations of the factor levels, see
+	// factorCells.
+	Factors []Factor
+
+	// The values of the variables for each cluster, and the
+	// treatment group of each randomized cluster, keyed by the
+	// cluster name.  Only used with cluster randomization, in which
+	// the clusters are the sites of the project.
+	ClusterValues map[string][]string
+	ClusterGroups map[string]string
+
+	// The record of each constrained randomization of the clusters.
+	ClusterRandomizations []*ClusterRandomization
+
+	// The later stages of a sequential multiple assignment
+	// randomized trial (SMART).  The treatment groups and variables
+	// of the project form the first stage.
+	Stages []*Stage
+
+	// The batches of subjects, such as matched pairs, that were
+	// assigned jointly.
+	Batches []*BatchAssignment
+}
+
+// Stage is a later stage of a sequential multiple assignment
+// randomized trial, in which eligible subjects are assigned again,
+// based on their group in the previous stage and their response.
+type Stage struct {
+	Name       string
+	GroupNames []string
+
+	// The variables used to assign the subjects within the stage.
+	// The first variable is the group in the previous stage.
+	Variables []Variable
+
+	// The groups of the previous stage whose subjects are eligible.
+	EligibleGroups []string
+
+	// If not blank, only subjects whose value of this variable is
+	// one of EligibleLevels are eligible.
+	EligibleVariable string
+	EligibleLevels   []string
+
+	// The bias of the minimization used within the stage, and the
+	// aggregate data of the stage, as in Project.
+	Bias        int
+	Assignments []int
+	Data        [][][]float64
+}
+
+// Factor is a treatment factor of a factorial design.
+type Factor struct {
+	Name   string
+	Levels []string
 }
 
 // EncodedProject is a version of Project that can be stored in the
 // datastore.  Appengine datastore doesn't handle structs containing
 // slices of other structs.
 type EncodedProject struct {
-	Owner           string
-	Created         time.Time
-	Name            string
-	GroupNames      []byte
-	Variables       []byte
-	Assignments     []int
-	Data            []byte
-	Bias            int
-	Comments        []byte
-	Modified        time.Time
-	StoreRawData    bool
-	RawData         []byte
-	NumAssignments  int
-	RemovedSubjects []string
-	Open            bool
-	SamplingRates   []float64
+	Owner                 string
+	Created               time.Time
+	Name                  string
+	GroupNames            []byte
+	Variables             []byte
+	Assignments           []int
+	Data                  []byte
+	Bias                  int
+	Comments              []byte
+	Modified              time.Time
+	StoreRawData          bool
+	RawData               []byte
+	NumAssignments        int
+	RemovedSubjects       []string
+	Open                  bool
+	SamplingRates         []float64
+	Method                string
+	BlockSizes            []int
+	Blocks                []byte
+	StratumAssignments    []byte
+	PlannedSize           int
+	CoinProb              float64
+	MaxImbalance          int
+	LevelMaxImbalance     int
+	OverallWeight         float64
+	Sites                 []string
+	GlobalWeight          float64
+	SiteData              []byte
+	SiteAssignments       []byte
+	UserSites             []byte
+	List                  []byte
+	OutcomeType           string
+	SmallerBetter         bool
+	BurnIn                int
+	MinProb               float64
+	MaxProb               float64
+	OutcomeStats          []byte
+	Factors               []byte
+	ClusterValues         []byte
+	ClusterGroups         []byte
+	ClusterRandomizations []byte
+	Stages                []byte
+	Batches               []byte
 }
 
 type EncodedProjectView struct {
@@ -116,25 +360,49 @@ type EncodedProjectView struct {
 
 // ProjectView is a printable version of Project.
 type ProjectView struct {
-	Owner           string
-	CreatedDate     string
-	CreatedTime     string
-	GroupNames      string
-	Name            string
-	Variables       []VariableView
-	Key             string
-	Assignments     []int
-	Data            [][][]float64
-	Bias            string
-	Comments        []*Comment
-	ModifiedDate    string
-	ModifiedTime    string
-	StoreRawData    bool
-	RawData         []byte
-	NumAssignments  int
-	RemovedSubjects []string
-	Open            bool
-	SamplingRates   string
+	Owner             string
+	CreatedDate       string
+	CreatedTime       string
+	GroupNames        string
+	Name              string
+	Variables         []VariableView
+	Key               string
+	Assignments       []int
+	Data              [][][]float64
+	Bias              string
+	Method            string
+	BlockSizes        string
+	CoinProb          string
+	MaxImbalance      string
+	LevelMaxImbalance string
+	OverallWeight     string
+	Sites             string
+	GlobalWeight      string
+	Comments          []*Comment
+	ModifiedDate      string
+	ModifiedTime      string
+	StoreRawData      bool
+	RawData           []byte
+	NumAssignments    int
+	RemovedSubjects   []string
+	Open              bool
+	SamplingRates     string
+	OutcomeType       string
+	BurnIn            string
+	ProbLimits        string
+	Factors           string
+	Stages            []string
+}
+
+// Block is a permuted block of treatment assignments.
+type Block struct {
+	// The positions of the groups within GroupNames, in the order
+	// that they are to be assigned.
+	Sequence []int
+
+	// The number of assignments that have already been made from
+	// this block.
+	Position int
 }
 
 // Variable contains information about one variable that will be used
@@ -144,15 +412,29 @@ type Variable struct {
 	Levels []string
 	Weight float64
 	Func   string
+
+	// Either "Categorical" or "Continuous", projects created before
+	// continuous variables were supported have a blank type and
+	// only categorical variables.  Continuous variables have no
+	// levels.
+	Type string
+
+	// If true, the value of the variable may be missing (blank)
+	// when a subject is assigned.  The variable is then ignored
+	// when assigning the subject, and the value can be filled in
+	// later.
+	AllowMissing bool
 }
 
 // VariableView is a printable version of a variable.
 type VariableView struct {
-	Name   string
-	Levels string
-	Index  int
-	Weight string
-	Func   string
+	Name    string
+	Levels  string
+	Index   int
+	Weight  string
+	Func    string
+	Type    string
+	Missing string
 }
 
 // SharingByUser is a record of all projects to which the given user
@@ -241,21 +523,80 @@ func copyEncodedProject(proj *EncodedProject) *EncodedProject {
 	newproj.SamplingRates = make([]float64, len(proj.SamplingRates))
 	copy(newproj.SamplingRates, proj.SamplingRates)
 
+	newproj.Method = proj.Method
+
+	newproj.BlockSizes = make([]int, len(proj.BlockSizes))
+	copy(newproj.BlockSizes, proj.BlockSizes)
+
+	newproj.Blocks = make([]byte, len(proj.Blocks))
+	copy(newproj.Blocks, proj.Blocks)
+
+	newproj.StratumAssignments = make([]byte, len(proj.StratumAssignments))
+	copy(newproj.StratumAssignments, proj.StratumAssignments)
+
+	newproj.PlannedSize = proj.PlannedSize
+	newproj.CoinProb = proj.CoinProb
+	newproj.MaxImbalance = proj.MaxImbalance
+	newproj.LevelMaxImbalance = proj.LevelMaxImbalance
+	newproj.OverallWeight = proj.OverallWeight
+
+	newproj.Sites = make([]string, len(proj.Sites))
+	copy(newproj.Sites, proj.Sites)
+
+	newproj.GlobalWeight = proj.GlobalWeight
+
+	newproj.SiteData = make([]byte, len(proj.SiteData))
+	copy(newproj.SiteData, proj.SiteData)
+
+	newproj.SiteAssignments = make([]byte, len(proj.SiteAssignments))
+	copy(newproj.SiteAssignments, proj.SiteAssignments)
+
+	newproj.UserSites = make([]byte, len(proj.UserSites))
+	copy(newproj.UserSites, proj.UserSites)
+
+	newproj.List = make([]byte, len(proj.List))
+	copy(newproj.List, proj.List)
+
+	newproj.OutcomeType = proj.OutcomeType
+	newproj.SmallerBetter = proj.SmallerBetter
+	newproj.BurnIn = proj.BurnIn
+	newproj.MinProb = proj.MinProb
+	newproj.MaxProb = proj.MaxProb
+
+	newproj.OutcomeStats = make([]byte, len(proj.OutcomeStats))
+	copy(newproj.OutcomeStats, proj.OutcomeStats)
+
+	newproj.Factors = make([]byte, len(proj.Factors))
+	copy(newproj.Factors, proj.Factors)
+
+	newproj.ClusterValues = make([]byte, len(proj.ClusterValues))
+	copy(newproj.ClusterValues, proj.ClusterValues)
+
+	newproj.ClusterGroups = make([]byte, len(proj.ClusterGroups))
+	copy(newproj.ClusterGroups, proj.ClusterGroups)
+
+	newproj.ClusterRandomizations = make([]byte, len(proj.ClusterRandomizations))
+	copy(newproj.ClusterRandomizations, proj.ClusterRandomizations)
+
+	newproj.Stages = make([]byte, len(proj.Stages))
+	copy(newproj.Stages, proj.Stages)
+
+	newproj.Batches = make([]byte, len(proj.Batches))
+	copy(newproj.Batches, proj.Batches)
+
 	return newproj
 }
 
 // getProjectfromKey
 func getProjectFromKey(ctx context.Context, pkey string) (*Project, error) {
 
-	ky := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	var eproj EncodedProject
-	err := datastore.Get(ctx, ky, &eproj)
+	eproj, err := repository.GetProject(ctx, pkey)
 	if err != nil {
 		log.Errorf(ctx, "Project_dashboard: %v", err)
 		return nil, err
 	}
 
-	project, err := decodeProject(&eproj)
+	project, err := decodeProject(eproj)
 	if err != nil {
 		return nil, err
 	}
@@ -270,6 +611,12 @@ func getProjectFromKey(ctx context.Context, pkey string) (*Project, error) {
 		project.SamplingRates = arr
 	}
 
+	// Projects created before the allocation method could be
+	// selected all use minimization.
+	if project.Method == "" {
+		project.Method = defaultMethod
+	}
+
 	return project, nil
 }
 
@@ -297,6 +644,20 @@ func encodeProject(proj *Project) (*EncodedProject, error) {
 	ep.RemovedSubjects = proj.RemovedSubjects
 	ep.Open = proj.Open
 	ep.SamplingRates = proj.SamplingRates
+	ep.Method = proj.Method
+	ep.BlockSizes = proj.BlockSizes
+	ep.PlannedSize = proj.PlannedSize
+	ep.CoinProb = proj.CoinProb
+	ep.MaxImbalance = proj.MaxImbalance
+	ep.LevelMaxImbalance = proj.LevelMaxImbalance
+	ep.OverallWeight = proj.OverallWeight
+	ep.Sites = proj.Sites
+	ep.GlobalWeight = proj.GlobalWeight
+	ep.OutcomeType = proj.OutcomeType
+	ep.SmallerBetter = proj.SmallerBetter
+	ep.BurnIn = proj.BurnIn
+	ep.MinProb = proj.MinProb
+	ep.MaxProb = proj.MaxProb
 
 	// Group names
 	x1, err := json.Marshal(proj.GroupNames)
@@ -328,6 +689,114 @@ func encodeProject(proj *Project) (*EncodedProject, error) {
 	}
 	ep.Comments = x4
 
+	// Blocks
+	if proj.Blocks != nil {
+		x5, err := json.Marshal(proj.Blocks)
+		if err != nil {
+			return nil, err
+		}
+		ep.Blocks = x5
+	}
+
+	// Assignments within strata
+	if proj.StratumAssignments != nil {
+		x6, err := json.Marshal(proj.StratumAssignments)
+		if err != nil {
+			return nil, err
+		}
+		ep.StratumAssignments = x6
+	}
+
+	// Aggregates within sites
+	if proj.SiteData != nil {
+		x7, err := json.Marshal(proj.SiteData)
+		if err != nil {
+			return nil, err
+		}
+		ep.SiteData = x7
+
+		x8, err := json.Marshal(proj.SiteAssignments)
+		if err != nil {
+			return nil, err
+		}
+		ep.SiteAssignments = x8
+	}
+
+	// Default sites of the users
+	if proj.UserSites != nil {
+		x9, err := json.Marshal(proj.UserSites)
+		if err != nil {
+			return nil, err
+		}
+		ep.UserSites = x9
+	}
+
+	// Randomization list
+	if proj.List != nil {
+		x10, err := json.Marshal(proj.List)
+		if err != nil {
+			return nil, err
+		}
+		ep.List = x10
+	}
+
+	// Outcome aggregates
+	if proj.OutcomeStats != nil {
+		x11, err := json.Marshal(proj.OutcomeStats)
+		if err != nil {
+			return nil, err
+		}
+		ep.OutcomeStats = x11
+	}
+
+	// Treatment factors
+	if proj.Factors != nil {
+		x12, err := json.Marshal(proj.Factors)
+		if err != nil {
+			return nil, err
+		}
+		ep.Factors = x12
+	}
+
+	// Clusters
+	if proj.ClusterValues != nil {
+		x13, err := json.Marshal(proj.ClusterValues)
+		if err != nil {
+			return nil, err
+		}
+		ep.ClusterValues = x13
+
+		x14, err := json.Marshal(proj.ClusterGroups)
+		if err != nil {
+			return nil, err
+		}
+		ep.ClusterGroups = x14
+
+		x15, err := json.Marshal(proj.ClusterRandomizations)
+		if err != nil {
+			return nil, err
+		}
+		ep.ClusterRandomizations = x15
+	}
+
+	// Later stages
+	if proj.Stages != nil {
+		x16, err := json.Marshal(proj.Stages)
+		if err != nil {
+			return nil, err
+		}
+		ep.Stages = x16
+	}
+
+	// Batch assignments
+	if proj.Batches != nil {
+		x17, err := json.Marshal(proj.Batches)
+		if err != nil {
+			return nil, err
+		}
+		ep.Batches = x17
+	}
+
 	return ep, nil
 }
 
@@ -339,10 +808,7 @@ func storeProject(ctx context.Context, proj *Project, projectKey string) error {
 		return err
 	}
 
-	pkey := datastore.NewKey(ctx, "EncodedProject", projectKey, 0, nil)
-	_, err = datastore.Put(ctx, pkey, ep)
-
-	return err
+	return repository.PutProject(ctx, projectKey, ep)
 }
 
 // decodeProject takes a project in its encoded form (storable in the
@@ -370,6 +836,20 @@ func decodeProject(eproj *EncodedProject) (*Project, error) {
 	proj.Modified = eproj.Modified
 	proj.Open = eproj.Open
 	proj.SamplingRates = eproj.SamplingRates
+	proj.Method = eproj.Method
+	proj.BlockSizes = eproj.BlockSizes
+	proj.PlannedSize = eproj.PlannedSize
+	proj.CoinProb = eproj.CoinProb
+	proj.MaxImbalance = eproj.MaxImbalance
+	proj.LevelMaxImbalance = eproj.LevelMaxImbalance
+	proj.OverallWeight = eproj.OverallWeight
+	proj.Sites = eproj.Sites
+	proj.GlobalWeight = eproj.GlobalWeight
+	proj.OutcomeType = eproj.OutcomeType
+	proj.SmallerBetter = eproj.SmallerBetter
+	proj.BurnIn = eproj.BurnIn
+	proj.MinProb = eproj.MinProb
+	proj.MaxProb = eproj.MaxProb
 
 	var groupNames []string
 	err = json.Unmarshal(eproj.GroupNames, &groupNames)
@@ -401,6 +881,123 @@ func decodeProject(eproj *EncodedProject) (*Project, error) {
 		proj.RawData = rawdata
 	}
 
+	if len(eproj.Blocks) > 0 {
+		var blocks map[string]*Block
+		err := json.Unmarshal(eproj.Blocks, &blocks)
+		if err != nil {
+			return nil, err
+		}
+		proj.Blocks = blocks
+	}
+
+	if len(eproj.StratumAssignments) > 0 {
+		var sa map[string][]int
+		err := json.Unmarshal(eproj.StratumAssignments, &sa)
+		if err != nil {
+			return nil, err
+		}
+		proj.StratumAssignments = sa
+	}
+
+	if len(eproj.SiteData) > 0 {
+		var sd map[string][][][]float64
+		err := json.Unmarshal(eproj.SiteData, &sd)
+		if err != nil {
+			return nil, err
+		}
+		proj.SiteData = sd
+	}
+
+	if len(eproj.SiteAssignments) > 0 {
+		var sa map[string][]int
+		err := json.Unmarshal(eproj.SiteAssignments, &sa)
+		if err != nil {
+			return nil, err
+		}
+		proj.SiteAssignments = sa
+	}
+
+	if len(eproj.UserSites) > 0 {
+		var us map[string]string
+		err := json.Unmarshal(eproj.UserSites, &us)
+		if err != nil {
+			return nil, err
+		}
+		proj.UserSites = us
+	}
+
+	if len(eproj.List) > 0 {
+		var list []*ListEntry
+		err := json.Unmarshal(eproj.List, &list)
+		if err != nil {
+			return nil, err
+		}
+		proj.List = list
+	}
+
+	if len(eproj.OutcomeStats) > 0 {
+		var os [][]float64
+		err := json.Unmarshal(eproj.OutcomeStats, &os)
+		if err != nil {
+			return nil, err
+		}
+		proj.OutcomeStats = os
+	}
+
+	if len(eproj.Factors) > 0 {
+		var fa []Factor
+		err := json.Unmarshal(eproj.Factors, &fa)
+		if err != nil {
+			return nil, err
+		}
+		proj.Factors = fa
+	}
+
+	if len(eproj.ClusterValues) > 0 {
+		var cv map[string][]string
+		err := json.Unmarshal(eproj.ClusterValues, &cv)
+		if err != nil {
+			return nil, err
+		}
+		proj.ClusterValues = cv
+	}
+
+	if len(eproj.ClusterGroups) > 0 {
+		var cg map[string]string
+		err := json.Unmarshal(eproj.ClusterGroups, &cg)
+		if err != nil {
+			return nil, err
+		}
+		proj.ClusterGroups = cg
+	}
+
+	if len(eproj.ClusterRandomizations) > 0 {
+		var cr []*ClusterRandomization
+		err := json.Unmarshal(eproj.ClusterRandomizations, &cr)
+		if err != nil {
+			return nil, err
+		}
+		proj.ClusterRandomizations = cr
+	}
+
+	if len(eproj.Stages) > 0 {
+		var st []*Stage
+		err := json.Unmarshal(eproj.Stages, &st)
+		if err != nil {
+			return nil, err
+		}
+		proj.Stages = st
+	}
+
+	if len(eproj.Batches) > 0 {
+		var ba []*BatchAssignment
+		err := json.Unmarshal(eproj.Batches, &ba)
+		if err != nil {
+			return nil, err
+		}
+		proj.Batches = ba
+	}
+
 	return proj, nil
 }
 
@@ -414,7 +1011,13 @@ func formatProject(project *Project) *ProjectView {
 	fp.Name = project.Name
 	fp.Comments = project.Comments
 	fp.Assignments = project.Assignments
-	fp.Bias = fmt.Sprintf("%d", project.Bias)
+	if project.Bias > 0 {
+		fp.Bias = fmt.Sprintf("%d", project.Bias)
+	}
+	fp.Method = project.Method
+	if am, err := getAllocationMethod(project.Method); err == nil {
+		fp.Method = am.Label
+	}
 	t := project.Created
 	loc, _ := time.LoadLocation("America/New_York")
 	t = t.In(loc)
@@ -429,6 +1032,47 @@ func formatProject(project *Project) *ProjectView {
 	}
 	fp.SamplingRates = strings.Join(rateStr, ",")
 
+	sizeStr := make([]string, len(project.BlockSizes))
+	for i, x := range project.BlockSizes {
+		sizeStr[i] = fmt.Sprintf("%d", x)
+	}
+	fp.BlockSizes = strings.Join(sizeStr, ",")
+
+	if project.CoinProb > 0 {
+		fp.CoinProb = fmt.Sprintf("%.2f", project.CoinProb)
+	}
+	if project.MaxImbalance > 0 {
+		fp.MaxImbalance = fmt.Sprintf("%d", project.MaxImbalance)
+	}
+	if project.LevelMaxImbalance > 0 {
+		fp.LevelMaxImbalance = fmt.Sprintf("%d", project.LevelMaxImbalance)
+	}
+	if project.OverallWeight > 0 {
+		fp.OverallWeight = fmt.Sprintf("%g", project.OverallWeight)
+	}
+	fp.Sites = strings.Join(project.Sites, ",")
+	if len(project.Sites) > 0 && project.Method == "Minimization" {
+		fp.GlobalWeight = fmt.Sprintf("%g", project.GlobalWeight)
+	}
+	if project.OutcomeType != "" {
+		fp.OutcomeType = project.OutcomeType
+		if project.SmallerBetter {
+			fp.OutcomeType += " (smaller is better)"
+		} else {
+			fp.OutcomeType += " (larger is better)"
+		}
+		fp.BurnIn = fmt.Sprintf("%d", project.BurnIn)
+		maxProb := project.MaxProb
+		if maxProb == 0 {
+			maxProb = 1
+		}
+		fp.ProbLimits = fmt.Sprintf("%g to %g", project.MinProb, maxProb)
+	}
+	fp.Factors = formatFactors(project.Factors)
+	for s := range project.Stages {
+		fp.Stages = append(fp.Stages, formatStage(project, s))
+	}
+
 	for i, pv := range project.Variables {
 		fp.Variables[i] = formatVariable(pv)
 	}
@@ -519,259 +1163,16 @@ func formatVariable(va Variable) VariableView {
 	vv.Levels = strings.Join(va.Levels, ",")
 	vv.Weight = fmt.Sprintf("%.0f", va.Weight)
 	vv.Func = va.Func
-
-	return vv
-}
-
-// getSharedUsers returns a list of user id's for for users who are
-// shared for the given project.
-func getSharedUsers(ctx context.Context, projectName string) ([]string, error) {
-
-	key := datastore.NewKey(ctx, "SharingByProject", projectName, 0, nil)
-
-	var sproj SharingByProject
-	err := datastore.Get(ctx, key, &sproj)
-	if err == datastore.ErrNoSuchEntity {
-		return []string{}, nil
-	} else if err != nil {
-		log.Errorf(ctx, "getSharedUsers: %v", err)
-		return []string{}, err
+	vv.Type = va.Type
+	if vv.Type == "" {
+		vv.Type = "Categorical"
 	}
-
-	if len(sproj.Users) == 0 {
-		return []string{}, nil
+	vv.Missing = "No"
+	if va.AllowMissing {
+		vv.Missing = "Yes"
 	}
 
-	users := cleanSplit(sproj.Users, ",")
-
-	return users, nil
-}
-
-// addSharing adds all the given users to be shared for the given
-// project.
-func addSharing(ctx context.Context, projectName string, userNames []string) error {
-
-	if len(userNames) == 0 {
-		return nil
-	}
-
-	// Update SharingByProject
-	key := datastore.NewKey(ctx, "SharingByProject", projectName, 0, nil)
-	sbproj := new(SharingByProject)
-	err := datastore.Get(ctx, key, sbproj)
-	if err == datastore.ErrNoSuchEntity {
-		// Create a new SharingByProject and carry on
-		sbproj.ProjectName = projectName
-		sbproj.Users = strings.Join(userNames, ",")
-	} else if err != nil {
-		log.Errorf(ctx, "addSharing [1]: %v", err)
-		return err
-	} else {
-		U := cleanSplit(sbproj.Users, ",")
-		m := make(map[string]bool)
-		for _, u := range U {
-			m[u] = true
-		}
-		for _, u := range userNames {
-			m[u] = true
-		}
-		A := make([]string, len(m))
-		i := 0
-		for k := range m {
-			A[i] = k
-			i++
-		}
-		sbproj.Users = strings.Join(A, ",")
-	}
-
-	_, err = datastore.Put(ctx, key, sbproj)
-	if err != nil {
-		log.Errorf(ctx, "addSharing: %v", err)
-		return err
-	}
-
-	// Update SharingByUser
-	for _, uname := range userNames {
-
-		key = datastore.NewKey(ctx, "SharingByUser", strings.ToLower(uname), 0, nil)
-		sbuser := new(SharingByUser)
-
-		err := datastore.Get(ctx, key, sbuser)
-		if err == datastore.ErrNoSuchEntity {
-			sbuser = new(SharingByUser)
-			sbuser.User = uname
-			sbuser.Projects = projectName
-		} else if err != nil {
-			log.Errorf(ctx, "addUser: %v", err)
-			return err
-		} else {
-			U := cleanSplit(sbuser.Projects, ",")
-			m := make(map[string]bool)
-			for _, u := range U {
-				m[u] = true
-			}
-			m[projectName] = true
-			A := make([]string, len(m))
-			i := 0
-			for k := range m {
-				A[i] = k
-				i++
-			}
-			sbuser.Projects = strings.Join(A, ",")
-		}
-
-		_, err = datastore.Put(ctx, key, sbuser)
-		if err != nil {
-			log.Errorf(ctx, "addUser: %v", err)
-			return err
-		}
-	}
-
-	return nil
-}
-
-// uniqueSvec returns an array containing the unique elements of the
-// given array.
-func uniqueSvec(vec []string) []string {
-
-	mp := make(map[string]bool)
-	for _, x := range vec {
-		mp[x] = true
-	}
-
-	uvec := make([]string, len(mp))
-	i := 0
-	for k := range mp {
-		uvec[i] = k
-		i++
-	}
-
-	return uvec
-}
-
-// sdiff returns the given vector with the elements in rm removed.
-func sdiff(vec []string, rm map[string]bool) []string {
-
-	dvec := make([]string, 0, len(vec))
-	for _, v := range vec {
-		_, ok := rm[v]
-		if !ok {
-			dvec = append(dvec, v)
-		}
-	}
-	return dvec
-}
-
-// removeSharing removes the given users from the access list for the given project.
-func removeSharing(ctx context.Context, projectName string, userNames []string) error {
-
-	// Map whose keys are the users to remove.
-	rmu := make(map[string]bool)
-	for i := 0; i < len(userNames); i++ {
-		rmu[userNames[i]] = true
-	}
-
-	// Update SharingByProject.
-	key := datastore.NewKey(ctx, "SharingByProject", projectName, 0, nil)
-	sproj := new(SharingByProject)
-	err := datastore.Get(ctx, key, sproj)
-	if err == datastore.ErrNoSuchEntity {
-		// OK
-	} else if err != nil {
-		return err
-	} else {
-		users := cleanSplit(sproj.Users, ",")
-		users = uniqueSvec(users)
-		users = sdiff(users, rmu)
-		sproj.Users = strings.Join(users, ",")
-		_, err = datastore.Put(ctx, key, sproj)
-		if err != nil {
-			return err
-		}
-	}
-
-	// Update SharingByUser
-	for _, name := range userNames {
-		pkey := datastore.NewKey(ctx, "SharingByUser", strings.ToLower(name), 0, nil)
-		suser := new(SharingByUser)
-		err := datastore.Get(ctx, pkey, suser)
-		if err == datastore.ErrNoSuchEntity {
-			// should not reach here
-		} else if err != nil {
-			return err
-		} else {
-			projlist := cleanSplit(suser.Projects, ",")
-			projlist = uniqueSvec(projlist)
-			projlist = sdiff(projlist, map[string]bool{projectName: true})
-			suser.Projects = strings.Join(projlist, ",")
-
-			_, err = datastore.Put(ctx, pkey, suser)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-// getProjects returns all projects owned by the given user.
-// Optionally also include projects that are shared with the user.
-func getProjects(ctx context.Context, user string, includeShared bool) ([]*datastore.Key, []*EncodedProject, error) {
-
-	qr := datastore.NewQuery("EncodedProject").
-		Filter("Owner = ", user).
-		Order("-Created").Limit(100)
-
-	keyset := make(map[string]bool)
-
-	var projlist []*EncodedProject
-	keylist, err := qr.GetAll(ctx, &projlist)
-	if err != nil {
-		log.Errorf(ctx, "GetProjects[1]: %v", err)
-		return nil, nil, err
-	}
-
-	if !includeShared {
-		return keylist, projlist, err
-	}
-
-	for _, k := range keylist {
-		keyset[k.String()] = true
-	}
-
-	// Get project ids that are shared with this user
-	ky2 := datastore.NewKey(ctx, "SharingByUser", strings.ToLower(user), 0, nil)
-	var spu SharingByUser
-	err = datastore.Get(ctx, ky2, &spu)
-	if err == datastore.ErrNoSuchEntity {
-		// No projects shared with this user
-		return keylist, projlist, nil
-	}
-	if err != nil {
-		log.Errorf(ctx, "getProjects[2]: %v", err)
-		return nil, nil, err
-	}
-
-	// Get the shared projects
-	spvl := cleanSplit(spu.Projects, ",")
-	for _, spv := range spvl {
-		ky := datastore.NewKey(ctx, "EncodedProject", spv, 0, nil)
-		_, ok := keyset[ky.String()]
-		if ok {
-			continue
-		}
-		keyset[ky.String()] = true
-		pr := new(EncodedProject)
-		err = datastore.Get(ctx, ky, pr)
-		if err != nil {
-			log.Infof(ctx, "getProjects [3]: %v\n%v", spv, err)
-			continue
-		}
-		keylist = append(keylist, ky)
-		projlist = append(projlist, pr)
-	}
-	return keylist, projlist, nil
+	return vv
 }
 
 // Serve404 is used when the GET/POST method is mismatched to the handler.
@@ -840,15 +1241,27 @@ func removeFromAggregate(rec *DataRecord, proj *Project) {
 	// Update the overall assignment totals
 	proj.Assignments[grpIx]--
 
+	// Update the within-stratum assignment totals
+	if proj.StratumAssignments != nil {
+		updateStratumAssignments(proj, stratumKey(rec.Data), grpIx, -1)
+	}
+
 	// Update the within-variable assignment totals
 	data := proj.Data
 	for j, va := range proj.Variables {
-		for k, lev := range va.Levels {
-			if rec.Data[j] == lev {
-				data[j][k][grpIx]--
-			}
-		}
+		_ = updateVariableData(&va, data[j], rec.Data[j], grpIx, -1)
 	}
+
+	// Update the within-site totals
+	_ = updateSiteAggregates(proj, rec.Site, rec.Data, grpIx, -1)
+
+	// Update the outcome totals
+	if rec.HasOutcome {
+		updateOutcomeStats(proj, grpIx, rec.Outcome, -1)
+	}
+
+	// Update the totals of the later stages
+	updateStageAggregates(proj, rec, -1)
 }
 
 // addToAggregate updates the aggregate statistics (count per
@@ -862,13 +1275,80 @@ func addToAggregate(rec *DataRecord,
 	// Update the overall assignment totals
 	proj.Assignments[grpIx]++
 
+	// Update the within-stratum assignment totals
+	if proj.StratumAssignments != nil {
+		updateStratumAssignments(proj, stratumKey(rec.Data), grpIx, 1)
+	}
+
 	// Update the within-variable assignment totals
 	data := proj.Data
 	for j, va := range proj.Variables {
-		for k, lev := range va.Levels {
-			if rec.Data[j] == lev {
-				data[j][k][grpIx]++
-			}
+		_ = updateVariableData(&va, data[j], rec.Data[j], grpIx, 1)
+	}
+
+	// Update the within-site totals
+	_ = updateSiteAggregates(proj, rec.Site, rec.Data, grpIx, 1)
+
+	// Update the outcome totals
+	if rec.HasOutcome {
+		updateOutcomeStats(proj, grpIx, rec.Outcome, 1)
+	}
+
+	// Update the totals of the later stages
+	updateStageAggregates(proj, rec, 1)
+}
+
+// newAggregateData returns zero aggregate data for the variables of
+// the project, see updateVariableData.
+func newAggregateData(project *Project) [][][]float64 {
+
+	numgroups := len(project.GroupNames)
+	data := make([][][]float64, len(project.Variables))
+	for j, va := range project.Variables {
+		// Continuous variables store the count, sum and sum of
+		// squares.
+		nrow := len(va.Levels)
+		if va.Type == "Continuous" {
+			nrow = 3
+		}
+		data[j] = make([][]float64, nrow)
+		for k := range data[j] {
+			data[j][k] = make([]float64, numgroups)
+		}
+	}
+
+	return data
+}
+
+// updateVariableData updates the aggregate data for one variable when
+// a subject with value x is added to (d=1) or removed from (d=-1)
+// group grp.  For a categorical variable, the aggregate data are the
+// counts per group (columns) within each level (rows).  For a
+// continuous variable, the three rows contain the count, sum, and
+// sum of squares of the values within each group.
+func updateVariableData(va *Variable, data [][]float64, x string, grp int, d float64) error {
+
+	// Missing values are not included in the aggregate data.
+	if x == "" && va.AllowMissing {
+		return nil
+	}
+
+	if va.Type == "Continuous" {
+		v, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return fmt.Errorf("The value '%s' of variable '%s' is not a number", x, va.Name)
 		}
+		data[0][grp] += d
+		data[1][grp] += d * v
+		data[2][grp] += d * v * v
+		return nil
+	}
+
+	k := getIndex(va.Levels, x)
+	if k == -1 {
+		return fmt.Errorf("The value '%s' of variable '%s' is not one of its levels", x, va.Name)
 	}
+	data[k][grp] += d
+
+	return nil
 }
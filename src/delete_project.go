@@ -5,7 +5,6 @@ import (
 	"strings"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -118,59 +117,17 @@ func deleteProjectStep3(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Delete the SharingByProject object, but first read the
-	// users list from it so we can delete the project from their
-	// SharingByUsers records.
-	key := datastore.NewKey(ctx, "SharingByProject", pkey, 0, nil)
-	var sbproj SharingByProject
-	var sharedWith []string
-	err := datastore.Get(ctx, key, &sbproj)
-	if err == datastore.ErrNoSuchEntity {
+	// Stop sharing the project, so that it is removed from the
+	// projects shared with each user.
+	err := repository.DeleteSharing(ctx, pkey)
+	if err != nil {
 		log.Errorf(ctx, "deleteProjectStep3 [2]: %v", err)
-	} else if err != nil {
-		log.Errorf(ctx, "deleteProjectStep3 [3] %v", err)
-	} else {
-		sharedWith = cleanSplit(sbproj.Users, ",")
-		err = datastore.Delete(ctx, key)
-		if err != nil {
-			log.Errorf(ctx, "deleteProjectStep3 [4] %v", err)
-		}
 	}
 
 	// Delete the project.
-	key = datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
-	err = datastore.Delete(ctx, key)
+	err = repository.DeleteProject(ctx, pkey)
 	if err != nil {
-		log.Errorf(ctx, "deleteProjectStep3 [5]: %v", err)
-	}
-
-	// Delete from each user's SharingByUser record.
-	for _, user1 := range sharedWith {
-		var sbuser SharingByUser
-		key := datastore.NewKey(ctx, "SharingByUser", strings.ToLower(user1), 0, nil)
-		err := datastore.Get(ctx, key, &sbuser)
-		if err != nil {
-			log.Errorf(ctx, "deleteProjectStep3 [6]: %v", err)
-		}
-		Projects := cleanSplit(sbuser.Projects, ",")
-
-		// Get the unique project keys, except for pkey.
-		mp := make(map[string]bool)
-		for _, x := range Projects {
-			if x != pkey {
-				mp[x] = true
-			}
-		}
-		var vec []string
-		for k := range mp {
-			vec = append(vec, k)
-		}
-		sbuser.Projects = strings.Join(vec, ",")
-
-		_, err = datastore.Put(ctx, key, &sbuser)
-		if err != nil {
-			log.Errorf(ctx, "deleteProjectStep3 [7]: %v", err)
-		}
+		log.Errorf(ctx, "deleteProjectStep3 [3]: %v", err)
 	}
 
 	tvals := struct {
@@ -5,58 +5,160 @@ import (
 	"math"
 	"math/rand"
 	"sort"
+	"strconv"
 	"time"
 )
 
-// doAssignment
-func doAssignment(M *map[string]string, project *Project, subjectId string, userId string) (string, error) {
+// doAssignment assigns a new subject to a treatment group, using the
+// allocation method selected for the project, and updates the
+// project to reflect the assignment.
+func doAssignment(M *map[string]string, site string, project *Project, subjectId string, userId string) (string, error) {
+
+	// Each assignment uses a new cryptographically random seed,
+	// which is stored with the subject's data so that the
+	// assignment can be reproduced, see replayAssignments.
+	seed, err := newSeed()
+	if err != nil {
+		return "", err
+	}
 
-	// Set the seed to a random time.  Not sure if this is needed,
-	// but since each assignment runs as a new instance we might
-	// be getting the same "random numbers" every time if we don't
-	// do this.
-	source := rand.NewSource(time.Now().UnixNano())
-	rgen := rand.New(source)
+	ii, probs, err := selectGroupProbs(M, site, project, seed)
+	if err != nil {
+		return "", err
+	}
 
-	numgroups := len(project.GroupNames)
-	numvar := len(project.Variables)
-	rates := project.SamplingRates
+	rec, err := recordAssignment(M, site, project, ii, subjectId, userId, seed)
+	if err != nil {
+		return "", err
+	}
+	if rec != nil {
+		rec.Probs = probs
+	}
+
+	return project.GroupNames[ii], nil
+}
+
+// recordAssignment updates the project to reflect the assignment of a
+// new subject with data values M to group ii.  The returned record is
+// nil if the complete data are not stored.
+func recordAssignment(M *map[string]string, site string, project *Project, ii int, subjectId string, userId string, seed int64) (*DataRecord, error) {
 
+	numvar := len(project.Variables)
 	data := project.Data
 
-	// Calculate the scores if assigning the new subject
-	// to each possible group.
-	potentialScores := make([]float64, numgroups)
-	for i := 0; i < numgroups; i++ {
+	values := make([]string, numvar)
+	for j, va := range project.Variables {
+		values[j] = (*M)[va.Name]
+	}
 
-		// The score is a weighted linear combination over the
-		// variables.
-		potentialScores[i] = 0
-		for j, va := range project.Variables {
-			x := (*M)[va.Name]
-			score := Score(x, i, data[j], rates, &va)
-			potentialScores[i] += va.Weight * score
+	// Update the project.
+	project.Assignments[ii]++
+	if project.StratumAssignments != nil {
+		updateStratumAssignments(project, stratumKey(values), ii, 1)
+	}
+	for j := 0; j < numvar; j++ {
+		VA := project.Variables[j]
+		err := updateVariableData(&VA, data[j], values[j], ii, 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := updateSiteAggregates(project, site, values, ii, 1); err != nil {
+		return nil, err
+	}
+	project.NumAssignments++
+
+	// Update the stored data
+	var rec *DataRecord
+	if project.StoreRawData {
+
+		rec = &DataRecord{
+			SubjectId:     subjectId,
+			AssignedTime:  time.Now(),
+			AssignedGroup: project.GroupNames[ii],
+			CurrentGroup:  project.GroupNames[ii],
+			Included:      true,
+			Data:          values,
+			Assigner:      userId,
+			Site:          site,
+			Seed:          seed,
+		}
+
+		project.RawData = append(project.RawData, rec)
+	}
+
+	return rec, nil
+}
+
+// selectGroup checks the subject's data, and returns the position of
+// the group selected by the project's allocation method using a random
+// number generator with the given seed.  The aggregate data are not
+// updated.
+func selectGroup(M *map[string]string, site string, project *Project, seed int64) (int, error) {
+
+	ii, _, err := selectGroupProbs(M, site, project, seed)
+	return ii, err
+}
+
+// selectGroupProbs is like selectGroup, but also returns the
+// probability with which each group was selected, or nil if the
+// allocation method does not report the probabilities.
+func selectGroupProbs(M *map[string]string, site string, project *Project, seed int64) (int, []float64, error) {
+
+	if err := checkSubjectData(M, project); err != nil {
+		return -1, nil, err
+	}
+
+	if len(project.Sites) > 0 && getIndex(project.Sites, site) == -1 {
+		return -1, nil, fmt.Errorf("Invalid site '%s'", site)
+	}
+
+	alloc, err := getAllocator(project.Method)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	// The probabilities are obtained before the assignment, since
+	// the allocator may update its state when assigning.
+	var probs []float64
+	if pa, ok := alloc.(ProbabilityAllocator); ok {
+		probs, err = pa.Probabilities(M, site, project, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			return -1, nil, err
 		}
 	}
 
+	rgen := rand.New(rand.NewSource(seed))
+
+	ii, err := alloc.Assign(M, site, project, rgen)
+	return ii, probs, err
+}
+
+// minimization implements the Pocock and Simon minimization method
+// (Biometrics 31, 1975).
+type minimization struct{}
+
+func (minimization) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	potentialScores, err := minimizationScores(M, site, project)
+	if err != nil {
+		return -1, err
+	}
+
+	// If the maximum tolerated imbalance would be exceeded by
+	// assigning the subject to some of the groups, the assignment
+	// is made deterministically.
+	if ties := excessTies(potentialScores, imbalanceExcess(M, project)); ties != nil {
+		return ties[rgen.Intn(len(ties))], nil
+	}
+
 	// Get a sorted copy of the scores.
 	sortedScores := make([]float64, len(potentialScores))
 	copy(sortedScores, potentialScores)
 	sort.Float64s(sortedScores)
 
-	// Construct the Pocock/Simon probabilities.
-	N := len(project.GroupNames)
-	qmin := 1 / float64(N)
-	qmax := 2 / float64(N-1)
-	qq := qmin + float64(project.Bias-1)*(qmax-qmin)/9.0
-	prob := make([]float64, N)
-	for j := range prob {
-		prob[j] = qq - 2*(float64(N)*qq-1)*float64(j+1)/float64(N*(N+1))
-	}
-
 	// The cumulative Pocock Simon probabilities.
-	cumprob := make([]float64, N)
-	copy(cumprob, prob)
+	cumprob := positionProbs(len(project.GroupNames), project.Bias)
 	for j := 1; j < len(cumprob); j++ {
 		cumprob[j] += cumprob[j-1]
 	}
@@ -81,52 +183,258 @@ func doAssignment(M *map[string]string, project *Project, subjectId string, user
 	}
 
 	// Assign to this group.
-	ii := ties[rgen.Intn(len(ties))]
+	return ties[rgen.Intn(len(ties))], nil
+}
 
-	// Update the project.
-	project.Assignments[ii]++
-	for j := 0; j < numvar; j++ {
+// Probabilities returns the probability with which each group would be
+// selected by Assign.  Groups with tied scores share the probabilities
+// of their positions among the sorted scores equally.
+func (minimization) Probabilities(M *map[string]string, site string, project *Project, rgen *rand.Rand) ([]float64, error) {
 
-		VA := project.Variables[j]
-		x := (*M)[VA.Name]
+	N := len(project.GroupNames)
 
-		kk := -1
-		for k, v := range VA.Levels {
-			if x == v {
-				kk = k
-				break
+	potentialScores, err := minimizationScores(M, site, project)
+	if err != nil {
+		return nil, err
+	}
+
+	probs := make([]float64, N)
+
+	// The deterministic assignment when the maximum tolerated
+	// imbalance would be exceeded, see Assign.
+	if ties := excessTies(potentialScores, imbalanceExcess(M, project)); ties != nil {
+		for _, i := range ties {
+			probs[i] = 1 / float64(len(ties))
+		}
+		return probs, nil
+	}
+
+	sortedScores := make([]float64, N)
+	copy(sortedScores, potentialScores)
+	sort.Float64s(sortedScores)
+
+	prob := positionProbs(N, project.Bias)
+	for i, x := range potentialScores {
+		var p float64
+		var nties int
+		for j, y := range sortedScores {
+			if y == x {
+				p += prob[j]
+				nties++
 			}
 		}
-		if kk == -1 {
-			return "", fmt.Errorf("Invalid state in Do_assignment")
+		probs[i] = p / float64(nties)
+	}
+
+	return probs, nil
+}
+
+// excessTies returns the groups among which a subject is assigned
+// deterministically because the maximum tolerated imbalance would be
+// exceeded by assigning the subject to some of the groups, see
+// imbalanceExcess.  These are the groups with the smallest score among
+// those that exceed it the least.  If no group exceeds it, nil is
+// returned.
+func excessTies(scores, excess []float64) []int {
+
+	minExcess, maxExcess := excess[0], excess[0]
+	for _, x := range excess {
+		minExcess = math.Min(minExcess, x)
+		maxExcess = math.Max(maxExcess, x)
+	}
+	if maxExcess <= 0 {
+		return nil
+	}
+
+	minScore := math.Inf(1)
+	for i, x := range scores {
+		if excess[i] == minExcess && x < minScore {
+			minScore = x
+		}
+	}
+	var ties []int
+	for i, x := range scores {
+		if excess[i] == minExcess && x == minScore {
+			ties = append(ties, i)
 		}
-		data[j][kk][ii]++
 	}
 
-	// Update the stored data
-	if project.StoreRawData {
+	return ties
+}
 
-		data := make([]string, len(project.Variables))
-		for j, v := range project.Variables {
-			data[j] = (*M)[v.Name]
+// positionProbs returns the Pocock Simon probabilities of selecting
+// the group at each position among the N sorted scores, where
+// position 0 has the smallest score.  The probabilities depend on the
+// bias, from 1 (equal probabilities) to 10 (most biased).
+func positionProbs(N int, bias int) []float64 {
+
+	qmin := 1 / float64(N)
+	qmax := 2 / float64(N-1)
+	qq := qmin + float64(bias-1)*(qmax-qmin)/9.0
+	prob := make([]float64, N)
+	for j := range prob {
+		prob[j] = qq - 2*(float64(N)*qq-1)*float64(j+1)/float64(N*(N+1))
+	}
+
+	return prob
+}
+
+// minimizationScores calculates the minimization score for assigning
+// the subject with data values M at the given site to each possible
+// group.  In a multi-center trial, the imbalance within the subject's
+// site is minimized, optionally combined with the overall imbalance.
+func minimizationScores(M *map[string]string, site string, project *Project) ([]float64, error) {
+
+	potentialScores, err := groupScores(M, project, project.Data, project.Assignments)
+	if err != nil {
+		return nil, err
+	}
+
+	if site != "" {
+		data, assignments := siteAggregates(project, site)
+		siteScores, err := groupScores(M, project, data, assignments)
+		if err != nil {
+			return nil, err
+		}
+		for i := range potentialScores {
+			potentialScores[i] = siteScores[i] + project.GlobalWeight*potentialScores[i]
 		}
+	}
 
-		rec := DataRecord{
-			SubjectId:     subjectId,
-			AssignedTime:  time.Now(),
-			AssignedGroup: project.GroupNames[ii],
-			CurrentGroup:  project.GroupNames[ii],
-			Included:      true,
-			Data:          data,
-			Assigner:      userId,
+	return potentialScores, nil
+}
+
+// groupScores calculates the minimization score for assigning the
+// subject with data values M to each possible group, based on the
+// given aggregate data and group sizes.
+func groupScores(M *map[string]string, project *Project, data [][][]float64, assignments []int) ([]float64, error) {
+
+	if len(project.Factors) > 0 {
+		return factorialScores(M, project, data, assignments)
+	}
+
+	numgroups := len(project.GroupNames)
+	rates := project.SamplingRates
+
+	// The overall numbers of subjects in the groups, treated as a
+	// variable with a single level.
+	var overall Variable
+	var overallCounts [][]float64
+	if project.OverallWeight > 0 {
+		overall = Variable{Name: "Overall", Levels: []string{""}, Func: "Range"}
+		overallCounts = [][]float64{make([]float64, numgroups)}
+		for i, n := range assignments {
+			overallCounts[0][i] = float64(n)
 		}
+	}
 
-		project.RawData = append(project.RawData, &rec)
+	// Calculate the scores if assigning the new subject
+	// to each possible group.
+	potentialScores := make([]float64, numgroups)
+	for i := 0; i < numgroups; i++ {
+
+		// The score is a weighted linear combination over the
+		// variables, and optionally the overall group sizes.
+		potentialScores[i] = 0
+		if project.OverallWeight > 0 {
+			score, err := Score("", i, overallCounts, rates, &overall)
+			if err != nil {
+				return nil, err
+			}
+			potentialScores[i] += project.OverallWeight * score
+		}
+		for j, va := range project.Variables {
+			x := (*M)[va.Name]
+			if x == "" && va.AllowMissing {
+				// A missing value does not contribute to
+				// the score.
+				continue
+			}
+			score, err := Score(x, i, data[j], rates, &va)
+			if err != nil {
+				return nil, err
+			}
+			potentialScores[i] += va.Weight * score
+		}
 	}
 
-	project.NumAssignments++
+	return potentialScores, nil
+}
 
-	return project.GroupNames[ii], nil
+// checkSubjectData returns an error if the data values in M are not
+// valid for the variables of the project.
+func checkSubjectData(M *map[string]string, project *Project) error {
+
+	for _, va := range project.Variables {
+		if err := checkValue(&va, (*M)[va.Name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkValue returns an error if x is not a valid value of the
+// variable va.
+func checkValue(va *Variable, x string) error {
+
+	if x == "" && va.AllowMissing {
+		return nil
+	}
+	if va.Type == "Continuous" {
+		if _, err := strconv.ParseFloat(x, 64); err != nil {
+			return fmt.Errorf("The value '%s' of variable '%s' is not a number", x, va.Name)
+		}
+	} else if getIndex(va.Levels, x) == -1 {
+		return fmt.Errorf("The value '%s' of variable '%s' is not one of its levels", x, va.Name)
+	}
+
+	return nil
+}
+
+// imbalanceExcess returns, for each treatment group, the amount by
+// which the maximum tolerated imbalances of the project would be
+// exceeded if the subject with data values M were assigned to the
+// group.  The imbalance is the range of the numbers of subjects in
+// the groups, after dividing by the sampling rates, either overall
+// or within the subject's level of each variable.
+func imbalanceExcess(M *map[string]string, project *Project) []float64 {
+
+	numgroups := len(project.GroupNames)
+	rates := project.SamplingRates
+
+	excess := make([]float64, numgroups)
+	counts := make([]float64, numgroups)
+	for i := 0; i < numgroups; i++ {
+
+		if project.MaxImbalance > 0 {
+			for k := range counts {
+				counts[k] = float64(project.Assignments[k])
+			}
+			counts[i]++
+			for k := range counts {
+				counts[k] /= rates[k]
+			}
+			excess[i] += math.Max(0, Range(counts)-float64(project.MaxImbalance))
+		}
+
+		if project.LevelMaxImbalance > 0 {
+			for j, va := range project.Variables {
+				lev := getIndex(va.Levels, (*M)[va.Name])
+				if lev == -1 {
+					continue
+				}
+				copy(counts, project.Data[j][lev])
+				counts[i]++
+				for k := range counts {
+					counts[k] /= rates[k]
+				}
+				excess[i] += math.Max(0, Range(counts)-float64(project.LevelMaxImbalance))
+			}
+		}
+	}
+
+	return excess
 }
 
 // Range returns the numerical range of the values in vec.
@@ -168,11 +476,29 @@ func StDev(vec []float64) float64 {
 // subject with data value `x` into group `grp` for a given variable
 // `va`.  `counts` contains the current cell counts for each level x group
 // combination for this variable, `va` contains variable information.
-func Score(x string, grp int, counts [][]float64, rates []float64, va *Variable) float64 {
+// An error is returned if the scoring function of the variable is not
+// known.
+func Score(x string, grp int, counts [][]float64, rates []float64, va *Variable) (float64, error) {
+
+	f, err := getImbalanceFunc(va.Func)
+	if err != nil {
+		return 0, err
+	}
+
+	if f.Continuous != (va.Type == "Continuous") {
+		return 0, fmt.Errorf("The scoring function '%s' cannot be used with variable '%s'", va.Func, va.Name)
+	}
+
+	if f.Continuous {
+		// The value was checked before scoring.
+		v, _ := strconv.ParseFloat(x, 64)
+		return continuousScore(v, grp, counts, va), nil
+	}
 
 	nlevel := len(va.Levels)
 	numGroups := len(counts[0])
 
+	oldCounts := make([]float64, numGroups)
 	newCounts := make([]float64, numGroups)
 	scoreChange := 0.0
 	for j := 0; j < nlevel; j++ {
@@ -194,18 +520,12 @@ func Score(x string, grp int, counts [][]float64, rates []float64, va *Variable)
 		// Adjust the counts to account for the intended
 		// marginal frequencies.
 		for i := 0; i < numGroups; i++ {
+			oldCounts[i] = counts[j][i] / rates[i]
 			newCounts[i] /= rates[i]
 		}
 
-		switch va.Func {
-		case "Range":
-			scoreChange += Range(newCounts)
-		case "StDev":
-			scoreChange += StDev(newCounts)
-		default:
-			panic("Error: Unknown scoring function\n")
-		}
+		scoreChange += f.Imbalance(oldCounts, newCounts, grp)
 	}
 
-	return scoreChange
+	return scoreChange, nil
 }
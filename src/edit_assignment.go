@@ -216,6 +216,7 @@ func editAssignmentCompleted(w http.ResponseWriter, r *http.Request) {
 			removeFromAggregate(rec, proj)
 			oldGroupName := rec.CurrentGroup
 			rec.CurrentGroup = newGroupName
+			rec.Edits = append(rec.Edits, GroupEdit{Time: time.Now(), Group: newGroupName})
 			addToAggregate(rec, proj)
 
 			comment := new(Comment)
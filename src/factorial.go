@@ -0,0 +1,229 @@
+package randomization
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseNamedLevels parses a list of names, each with a list of
+// levels.  The entries are separated by semicolons, and each entry is
+// given by its name, a colon, and a comma separated list of its
+// levels, for example "Drug: Active, Placebo; Diet: Low, Usual".  The
+// entries are returned as factors.
+func parseNamedLevels(s string) ([]Factor, error) {
+
+	var entries []Factor
+	seen := make(map[string]bool)
+	for _, fs := range cleanSplit(s, ";") {
+		parts := strings.SplitN(fs, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("'%s' does not have the form 'name: level1, level2, ...'.", fs)
+		}
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			return nil, fmt.Errorf("names may not be blank.")
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("'%s' is listed more than once.", name)
+		}
+		seen[name] = true
+
+		levels := cleanSplit(parts[1], ",")
+		if len(levels) < 2 {
+			return nil, fmt.Errorf("'%s' must have at least two levels.", name)
+		}
+		lseen := make(map[string]bool)
+		for _, x := range levels {
+			if x == "" {
+				return nil, fmt.Errorf("the levels of '%s' may not be blank.", name)
+			}
+			if lseen[x] {
+				return nil, fmt.Errorf("the level '%s' of '%s' is listed more than once.", x, name)
+			}
+			lseen[x] = true
+		}
+
+		entries = append(entries, Factor{Name: name, Levels: levels})
+	}
+
+	return entries, nil
+}
+
+// parseFactors converts a description of the treatment factors of a
+// factorial design to a slice, in the form used by parseNamedLevels.
+// A blank description means that the design is not factorial.
+func parseFactors(s string) ([]Factor, error) {
+
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	factors, err := parseNamedLevels(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fa := range factors {
+		for _, x := range fa.Levels {
+			if strings.Contains(x, "/") {
+				return nil, fmt.Errorf("the levels of factor '%s' may not contain '/'.", fa.Name)
+			}
+		}
+	}
+
+	if len(factors) < 2 {
+		return nil, fmt.Errorf("a factorial design must have at least two factors.")
+	}
+
+	return factors, nil
+}
+
+// formatFactors returns a description of the treatment factors in the
+// form used by parseFactors.
+func formatFactors(factors []Factor) string {
+
+	parts := make([]string, len(factors))
+	for i, fa := range factors {
+		parts[i] = fa.Name + ": " + strings.Join(fa.Levels, ", ")
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// factorCells returns the names of the treatment groups of a factorial
+// design, one for each combination of the factor levels.  The name of
+// a group is the names of its levels joined with "/", and the levels
+// of the last factor vary fastest.
+func factorCells(factors []Factor) []string {
+
+	cells := []string{""}
+	for i, fa := range factors {
+		var next []string
+		for _, c := range cells {
+			for _, x := range fa.Levels {
+				if i > 0 {
+					x = c + "/" + x
+				}
+				next = append(next, x)
+			}
+		}
+		cells = next
+	}
+
+	return cells
+}
+
+// cellLevels returns the position of the level of each factor within
+// treatment group grp of a factorial design.
+func cellLevels(factors []Factor, grp int) []int {
+
+	levels := make([]int, len(factors))
+	for f := len(factors) - 1; f >= 0; f-- {
+		n := len(factors[f].Levels)
+		levels[f] = grp % n
+		grp /= n
+	}
+
+	return levels
+}
+
+// groupFactorLevels returns the level of each factor within the named
+// treatment group, or blanks if the group is not known.
+func groupFactorLevels(project *Project, group string) []string {
+
+	levels := make([]string, len(project.Factors))
+	grp := getIndex(project.GroupNames, group)
+	if grp == -1 {
+		return levels
+	}
+	for f, k := range cellLevels(project.Factors, grp) {
+		levels[f] = project.Factors[f].Levels[k]
+	}
+
+	return levels
+}
+
+// factorMargin collapses the aggregate data and group sizes of a
+// factorial design over all factors except factor f.  The returned
+// project is a copy of the project in which the treatment groups are
+// the levels of factor f, with the corresponding sampling rates.
+func factorMargin(project *Project, data [][][]float64, assignments []int, f int) (*Project, [][][]float64, []int) {
+
+	mp := *project
+	mp.Factors = nil
+	mp.GroupNames = project.Factors[f].Levels
+	nlev := len(mp.GroupNames)
+
+	mp.SamplingRates = make([]float64, nlev)
+	mdata := make([][][]float64, len(data))
+	for j := range data {
+		mdata[j] = make([][]float64, len(data[j]))
+		for k := range data[j] {
+			mdata[j][k] = make([]float64, nlev)
+		}
+	}
+	massign := make([]int, nlev)
+
+	for i := range project.GroupNames {
+		q := cellLevels(project.Factors, i)[f]
+		mp.SamplingRates[q] += project.SamplingRates[i]
+		massign[q] += assignments[i]
+		for j := range data {
+			for k := range data[j] {
+				mdata[j][k][q] += data[j][k][i]
+			}
+		}
+	}
+
+	return &mp, mdata, massign
+}
+
+// factorialScores calculates the minimization score for assigning the
+// subject with data values M to each treatment group of a factorial
+// design.  The balance of each factor is scored separately, over the
+// margins of the other factors, and the score of a group is the sum of
+// the scores of its levels.
+func factorialScores(M *map[string]string, project *Project, data [][][]float64, assignments []int) ([]float64, error) {
+
+	scores := make([]float64, len(project.GroupNames))
+	for f := range project.Factors {
+		mp, mdata, massign := factorMargin(project, data, assignments, f)
+		mscores, err := groupScores(M, mp, mdata, massign)
+		if err != nil {
+			return nil, err
+		}
+		for i := range scores {
+			scores[i] += mscores[cellLevels(project.Factors, i)[f]]
+		}
+	}
+
+	return scores, nil
+}
+
+// FactorStat contains the numbers of subjects assigned to each level
+// of a treatment factor, overall and within the levels of the
+// variables.
+type FactorStat struct {
+	Name   string
+	Levels []string
+	Stat   [][]string
+}
+
+// factorStats returns the statistics of each factor of a factorial
+// design.
+func factorStats(project *Project) []*FactorStat {
+
+	var stats []*FactorStat
+	for f, fa := range project.Factors {
+		mp, mdata, massign := factorMargin(project, project.Data, project.Assignments, f)
+		row := make([]string, 1+len(fa.Levels))
+		row[0] = "All subjects"
+		for q, n := range massign {
+			row[q+1] = fmt.Sprintf("%d", n)
+		}
+		stat := append([][]string{row}, levelStats(mp, mdata, massign, "")...)
+		stats = append(stats, &FactorStat{Name: fa.Name, Levels: fa.Levels, Stat: stat})
+	}
+
+	return stats
+}
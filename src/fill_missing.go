@@ -0,0 +1,190 @@
+package randomization
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// fillValue sets the missing value of variable j for a subject, and
+// adds the value to the aggregate data if the subject is included in
+// the project.
+func fillValue(proj *Project, rec *DataRecord, j int, x string) error {
+
+	va := proj.Variables[j]
+	if rec.Data[j] != "" {
+		return fmt.Errorf("The value of variable '%s' is not missing", va.Name)
+	}
+	if x == "" {
+		return fmt.Errorf("No value was provided for variable '%s'", va.Name)
+	}
+	if err := checkValue(&va, x); err != nil {
+		return err
+	}
+
+	rec.Data[j] = x
+	if !rec.Included {
+		return nil
+	}
+
+	grp := getIndex(proj.GroupNames, rec.CurrentGroup)
+	if err := updateVariableData(&va, proj.Data[j], x, grp, 1); err != nil {
+		return err
+	}
+	if rec.Site != "" && proj.SiteData != nil {
+		data, assignments := siteAggregates(proj, rec.Site)
+		proj.SiteData[rec.Site] = data
+		proj.SiteAssignments[rec.Site] = assignments
+		if err := updateVariableData(&va, data[j], x, grp, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fillMissing displays the missing values of the subjects, with a form
+// to fill in each value.
+func fillMissing(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	proj, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "fillMissing: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !proj.StoreRawData {
+		msg := "Missing values cannot be filled in for a project in which the subject level data is not stored."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	// Each row contains a subject id and the variable whose value
+	// is missing.
+	var missing [][]string
+	for _, rec := range proj.RawData {
+		for j, va := range proj.Variables {
+			if va.AllowMissing && rec.Data[j] == "" {
+				missing = append(missing, []string{rec.SubjectId, va.Name})
+			}
+		}
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		Pkey        string
+		ProjectName string
+		Missing     [][]string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		Pkey:        pkey,
+		ProjectName: proj.Name,
+		Missing:     missing,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "fill_missing.html", tvals); err != nil {
+		log.Errorf(ctx, "fillMissing failed to execute template: %v", err)
+	}
+}
+
+// fillMissingConfirm stores a value that was previously missing.
+func fillMissingConfirm(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	proj, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "fillMissingConfirm: %v", err)
+		msg := "Datastore error: unable to retrieve project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectId := r.FormValue("subject_id")
+	vname := r.FormValue("variable")
+	x := strings.TrimSpace(r.FormValue("value"))
+
+	j := -1
+	for k, va := range proj.Variables {
+		if va.Name == vname {
+			j = k
+		}
+	}
+
+	var rec *DataRecord
+	for _, z := range proj.RawData {
+		if z.SubjectId == subjectId {
+			rec = z
+		}
+	}
+
+	if j == -1 || rec == nil {
+		msg := fmt.Sprintf("There is no subject '%s' with variable '%s' in the project.", subjectId, vname)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if err := fillValue(proj, rec, j, x); err != nil {
+		msg := fmt.Sprintf("The value was not stored: %v.", err)
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	rec.Fills = append(rec.Fills, ValueFill{Time: time.Now(), Variable: vname, Value: x})
+
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{
+		fmt.Sprintf("Missing value of variable '%s' for subject '%s' filled in as '%s'.", vname, subjectId, x)}
+	proj.Comments = append(proj.Comments, comment)
+
+	if err := storeProject(ctx, proj, pkey); err != nil {
+		log.Errorf(ctx, "fillMissingConfirm: %v", err)
+		msg := "Datastore error: unable to save project."
+		rmsg := "Return to project dashboard"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The value of variable '%s' for subject '%s' has been stored.", vname, subjectId)
+	rmsg := "Return to missing values"
+	messagePage(w, r, user, msg, rmsg, "/fill_missing?pkey="+pkey)
+}
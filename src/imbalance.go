@@ -0,0 +1,189 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+)
+
+// ImbalanceFunc describes a function that measures the imbalance among
+// the treatment groups for one variable, which the minimization
+// algorithm aims to minimize.
+type ImbalanceFunc struct {
+	// The name that is stored with the variable
+	Name string
+
+	// A human-readable name of the function
+	Label string
+
+	// A description of the function for the project creation pages
+	Description string
+
+	// If true, the function is used with continuous variables,
+	// otherwise it is used with categorical variables.
+	Continuous bool
+
+	// Imbalance returns the imbalance within one level of a
+	// categorical variable.  The counts per group within the
+	// level, divided by the sampling rates, are given before
+	// (`before`) and after (`after`) assigning a subject to group
+	// `grp`.  Imbalance is nil for continuous functions, which are
+	// evaluated by continuousScore.
+	Imbalance func(before, after []float64, grp int) float64
+}
+
+// imbalanceFuncs contains all available imbalance functions, in the
+// order that they are offered during project creation.
+var imbalanceFuncs = []*ImbalanceFunc{
+	{
+		Name:        "Range",
+		Label:       "Range",
+		Description: "the largest minus the smallest count",
+		Imbalance:   func(before, after []float64, grp int) float64 { return Range(after) },
+	},
+	{
+		Name:        "StDev",
+		Label:       "Standard deviation",
+		Description: "the standard deviation of the counts",
+		Imbalance:   func(before, after []float64, grp int) float64 { return StDev(after) },
+	},
+	{
+		Name:        "Variance",
+		Label:       "Variance",
+		Description: "the variance of the counts",
+		Imbalance:   func(before, after []float64, grp int) float64 { return Variance(after) },
+	},
+	{
+		Name:  "IsMin",
+		Label: "Is minimum",
+		Description: "zero if the subject is assigned to a group that currently has the smallest " +
+			"count, otherwise one",
+		Imbalance: IsMin,
+	},
+	{
+		Name:        "ChiSquare",
+		Label:       "Chi-square",
+		Description: "the chi-square statistic comparing the counts to their mean",
+		Imbalance:   func(before, after []float64, grp int) float64 { return ChiSquare(after) },
+	},
+	{
+		Name:        "TotalAbsDev",
+		Label:       "Total absolute deviation",
+		Description: "the sum of the absolute differences between the counts and their mean",
+		Imbalance:   func(before, after []float64, grp int) float64 { return TotalAbsDev(after) },
+	},
+	{
+		Name:  "StdMean",
+		Label: "Standardized mean (continuous)",
+		Description: "the range of the treatment group means, divided by the overall standard " +
+			"deviation",
+		Continuous: true,
+	},
+	{
+		Name:  "StdMeanVar",
+		Label: "Standardized mean and variance (continuous)",
+		Description: "the standardized mean, plus the range of the logarithms of the treatment " +
+			"group standard deviations",
+		Continuous: true,
+	},
+}
+
+// getImbalanceFunc returns the imbalance function with the given name.
+func getImbalanceFunc(name string) (*ImbalanceFunc, error) {
+
+	for _, f := range imbalanceFuncs {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown scoring function '%s'", name)
+}
+
+// variableImbalance returns the current imbalance of a variable under
+// its scoring function, given its aggregate data and the sampling
+// rates.  The imbalance of a categorical variable only uses the
+// non-missing levels.  NaN is returned if the imbalance is not
+// defined.
+func variableImbalance(va *Variable, data [][]float64, rates []float64) float64 {
+
+	f, err := getImbalanceFunc(va.Func)
+	if err != nil {
+		return math.NaN()
+	}
+	if f.Continuous {
+		return continuousImbalance(data, va)
+	}
+	if f.Name == "IsMin" {
+		return math.NaN()
+	}
+
+	imb := 0.0
+	adj := make([]float64, len(rates))
+	for k := range va.Levels {
+		for i := range adj {
+			adj[i] = data[k][i] / rates[i]
+		}
+		imb += f.Imbalance(adj, adj, 0)
+	}
+
+	return imb
+}
+
+// Variance returns the variance of the values in vec.
+func Variance(vec []float64) float64 {
+
+	sd := StDev(vec)
+	return sd * sd
+}
+
+// IsMin returns zero if group grp has the smallest value in before,
+// possibly tied with other groups, and otherwise returns one.
+func IsMin(before, after []float64, grp int) float64 {
+
+	for _, x := range before {
+		if x < before[grp] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// ChiSquare returns the chi-square statistic comparing the values in vec
+// to their mean.
+func ChiSquare(vec []float64) float64 {
+
+	m := 0.0
+	for _, x := range vec {
+		m += x
+	}
+	m /= float64(len(vec))
+
+	if m == 0 {
+		return 0
+	}
+
+	c := 0.0
+	for _, x := range vec {
+		d := x - m
+		c += d * d / m
+	}
+
+	return c
+}
+
+// TotalAbsDev returns the sum of the absolute deviations of the values in
+// vec from their mean.
+func TotalAbsDev(vec []float64) float64 {
+
+	m := 0.0
+	for _, x := range vec {
+		m += x
+	}
+	m /= float64(len(vec))
+
+	t := 0.0
+	for _, x := range vec {
+		t += math.Abs(x - m)
+	}
+
+	return t
+}
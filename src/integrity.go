@@ -0,0 +1,370 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// AggregateDifference describes one value of the stored aggregate data
+// that does not match the value rebuilt from the subject level data.
+type AggregateDifference struct {
+	Item    string
+	Stored  string
+	Rebuilt string
+}
+
+// rebuildAggregates recomputes the aggregate data of the project from
+// the records of the subjects who are currently included, using their
+// current groups and data values.  The aggregates are returned in a
+// copy of the project, whose other fields are shared with the project.
+// An error is returned if a record cannot be added to the aggregates.
+func rebuildAggregates(project *Project) (*Project, error) {
+
+	fresh := initialProject(project)
+
+	for _, rec := range project.RawData {
+		if !rec.Included {
+			continue
+		}
+
+		grp := getIndex(project.GroupNames, rec.CurrentGroup)
+		if grp == -1 {
+			return nil, fmt.Errorf("subject '%s' is in the unknown group '%s'", rec.SubjectId, rec.CurrentGroup)
+		}
+		if len(rec.Data) != len(project.Variables) {
+			return nil, fmt.Errorf("subject '%s' does not have a value for each variable", rec.SubjectId)
+		}
+
+		fresh.Assignments[grp]++
+		fresh.NumAssignments++
+		if fresh.StratumAssignments != nil {
+			updateStratumAssignments(fresh, stratumKey(rec.Data), grp, 1)
+		}
+		for j, va := range project.Variables {
+			if err := updateVariableData(&va, fresh.Data[j], rec.Data[j], grp, 1); err != nil {
+				return nil, fmt.Errorf("subject '%s': %v", rec.SubjectId, err)
+			}
+		}
+		if err := updateSiteAggregates(fresh, rec.Site, rec.Data, grp, 1); err != nil {
+			return nil, fmt.Errorf("subject '%s': %v", rec.SubjectId, err)
+		}
+		if rec.HasOutcome {
+			updateOutcomeStats(fresh, grp, rec.Outcome, 1)
+		}
+		for _, sa := range rec.StageAssignments {
+			if sa.Stage >= len(fresh.Stages) || getIndex(fresh.Stages[sa.Stage].GroupNames, sa.Group) == -1 {
+				return nil, fmt.Errorf("subject '%s' has an unknown later stage assignment", rec.SubjectId)
+			}
+			if err := updateStage(fresh, sa, 1); err != nil {
+				return nil, fmt.Errorf("subject '%s': %v", rec.SubjectId, err)
+			}
+		}
+	}
+
+	return fresh, nil
+}
+
+// sameValue returns true if the stored and rebuilt values are equal,
+// allowing for the rounding error of sums of continuous values.
+func sameValue(a, b float64) bool {
+
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// compareCounts appends a difference for each group whose stored and
+// rebuilt numbers of subjects differ.  A missing slice is taken to be
+// zero.
+func compareCounts(diffs []*AggregateDifference, item string, groups []string, stored, rebuilt []int) []*AggregateDifference {
+
+	for i, g := range groups {
+		var a, b int
+		if i < len(stored) {
+			a = stored[i]
+		}
+		if i < len(rebuilt) {
+			b = rebuilt[i]
+		}
+		if a != b {
+			diffs = append(diffs, &AggregateDifference{
+				Item:    fmt.Sprintf("%s, group %s", item, g),
+				Stored:  fmt.Sprintf("%d", a),
+				Rebuilt: fmt.Sprintf("%d", b),
+			})
+		}
+	}
+
+	return diffs
+}
+
+// compareVariableData appends a difference for each value of the
+// aggregate data of the variables that differs between the stored and
+// rebuilt data, see updateVariableData.  Missing data are taken to be
+// zero.
+func compareVariableData(diffs []*AggregateDifference, prefix string, variables []Variable, groups []string, stored, rebuilt [][][]float64) []*AggregateDifference {
+
+	for j, va := range variables {
+		labels := va.Levels
+		if va.Type == "Continuous" {
+			labels = []string{"number of values", "sum", "sum of squares"}
+		}
+		for k, label := range labels {
+			for i, g := range groups {
+				var a, b float64
+				if j < len(stored) && k < len(stored[j]) && i < len(stored[j][k]) {
+					a = stored[j][k][i]
+				}
+				if j < len(rebuilt) && k < len(rebuilt[j]) && i < len(rebuilt[j][k]) {
+					b = rebuilt[j][k][i]
+				}
+				if !sameValue(a, b) {
+					item := fmt.Sprintf("%s%s=%s, group %s", prefix, va.Name, label, g)
+					if va.Type == "Continuous" {
+						item = fmt.Sprintf("%s%s %s, group %s", prefix, va.Name, label, g)
+					}
+					diffs = append(diffs, &AggregateDifference{
+						Item:    item,
+						Stored:  fmt.Sprintf("%g", a),
+						Rebuilt: fmt.Sprintf("%g", b),
+					})
+				}
+			}
+		}
+	}
+
+	return diffs
+}
+
+// compareAggregates returns the differences between the stored
+// aggregate data of the project and the rebuilt aggregates.
+func compareAggregates(project, fresh *Project) []*AggregateDifference {
+
+	var diffs []*AggregateDifference
+	groups := project.GroupNames
+
+	if project.NumAssignments != fresh.NumAssignments {
+		diffs = append(diffs, &AggregateDifference{
+			Item:    "Number of included subjects",
+			Stored:  fmt.Sprintf("%d", project.NumAssignments),
+			Rebuilt: fmt.Sprintf("%d", fresh.NumAssignments),
+		})
+	}
+	diffs = compareCounts(diffs, "Subjects", groups, project.Assignments, fresh.Assignments)
+	diffs = compareVariableData(diffs, "", project.Variables, groups, project.Data, fresh.Data)
+
+	// Strata and sites that are only present in one of the
+	// aggregates are compared with zero counts.
+	var keys []string
+	seen := make(map[string]bool)
+	for _, m := range []map[string][]int{project.StratumAssignments, fresh.StratumAssignments} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		diffs = compareCounts(diffs, "Stratum "+k, groups, project.StratumAssignments[k], fresh.StratumAssignments[k])
+	}
+
+	keys = nil
+	seen = make(map[string]bool)
+	for _, m := range []map[string][]int{project.SiteAssignments, fresh.SiteAssignments} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		diffs = compareCounts(diffs, "Site "+k+": subjects", groups, project.SiteAssignments[k], fresh.SiteAssignments[k])
+		diffs = compareVariableData(diffs, "Site "+k+": ", project.Variables, groups, project.SiteData[k], fresh.SiteData[k])
+	}
+
+	if project.OutcomeStats != nil {
+		outcome := Variable{Name: "Outcome", Type: "Continuous"}
+		diffs = compareVariableData(diffs, "", []Variable{outcome}, groups,
+			[][][]float64{project.OutcomeStats}, [][][]float64{fresh.OutcomeStats})
+	}
+
+	for s, st := range project.Stages {
+		fs := fresh.Stages[s]
+		diffs = compareCounts(diffs, st.Name+": subjects", st.GroupNames, st.Assignments, fs.Assignments)
+		diffs = compareVariableData(diffs, st.Name+": ", st.Variables, st.GroupNames, st.Data, fs.Data)
+	}
+
+	return diffs
+}
+
+// repairAggregates replaces the aggregate data of the project with the
+// rebuilt aggregates.
+func repairAggregates(project, fresh *Project) {
+
+	project.NumAssignments = fresh.NumAssignments
+	project.Assignments = fresh.Assignments
+	project.Data = fresh.Data
+	project.StratumAssignments = fresh.StratumAssignments
+	project.SiteData = fresh.SiteData
+	project.SiteAssignments = fresh.SiteAssignments
+	project.OutcomeStats = fresh.OutcomeStats
+	for s, st := range project.Stages {
+		st.Assignments = fresh.Stages[s].Assignments
+		st.Data = fresh.Stages[s].Data
+	}
+}
+
+// getIntegrityProject returns the project if the user is its owner and
+// its subject level data are stored, otherwise a message is displayed
+// and nil is returned.
+func getIntegrityProject(w http.ResponseWriter, r *http.Request, pkey string) *Project {
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return nil
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "getIntegrityProject: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return nil
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the project owner can verify and repair the aggregate data."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	if !project.StoreRawData {
+		msg := "The aggregate data can only be verified for a project in which the subject level data are stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	return project
+}
+
+// verifyAggregates compares the stored aggregate data of a project with
+// the aggregates rebuilt from the subject level data, and displays the
+// differences.
+func verifyAggregates(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getIntegrityProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	var diffs []*AggregateDifference
+	fresh, err := rebuildAggregates(project)
+	if err == nil {
+		diffs = compareAggregates(project, fresh)
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		NumRecords  int
+		Error       string
+		Differences []*AggregateDifference
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		NumRecords:  len(project.RawData),
+		Differences: diffs,
+	}
+	if err != nil {
+		tvals.Error = err.Error()
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "verify_aggregates.html", tvals); err != nil {
+		log.Errorf(ctx, "verifyAggregates failed to execute template: %v", err)
+	}
+}
+
+// repairAggregatesPage rewrites the aggregate data of a project from
+// the subject level data, and records a comment.
+func repairAggregatesPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getIntegrityProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	fresh, err := rebuildAggregates(project)
+	if err != nil {
+		msg := fmt.Sprintf("The aggregate data could not be rebuilt: %v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	diffs := compareAggregates(project, fresh)
+	if len(diffs) == 0 {
+		msg := "The aggregate data match the subject level data, and were not changed."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	repairAggregates(project, fresh)
+
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{fmt.Sprintf("The aggregate data were rebuilt from the subject level data, correcting %d values.", len(diffs))}
+	for _, d := range diffs {
+		comment.Comment = append(comment.Comment, fmt.Sprintf("%s: %s changed to %s", d.Item, d.Stored, d.Rebuilt))
+	}
+	project.Comments = append(project.Comments, comment)
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "repairAggregatesPage: %v", err)
+		msg := "Error, the project was not saved."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The aggregate data have been rebuilt, correcting %d values.", len(diffs))
+	rmsg := "Return to project"
+	messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
@@ -0,0 +1,498 @@
+package randomization
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// ListEntry is one entry of a pre-generated randomization list.
+type ListEntry struct {
+	// The stratum to which the entry belongs, see listStratum.
+	// Blank if the list is not stratified.
+	Stratum string
+
+	// An optional label of the block containing the entry.
+	Block string
+
+	// The name of the treatment group.
+	Group string
+
+	// True if the entry has been dispensed to a subject.
+	Used bool
+}
+
+// randomizationList dispenses the entries of a pre-generated
+// randomization list in sequence.  If the list is stratified, the
+// next unused entry within the subject's stratum is dispensed.
+type randomizationList struct{}
+
+func (randomizationList) Assign(M *map[string]string, site string, project *Project, rgen *rand.Rand) (int, error) {
+
+	stratum := ""
+	if listIsStratified(project.List) {
+		stratum = listStratum(M, site, project)
+	}
+
+	for _, entry := range project.List {
+		if entry.Used || entry.Stratum != stratum {
+			continue
+		}
+		grp := getIndex(project.GroupNames, entry.Group)
+		if grp == -1 {
+			return -1, fmt.Errorf("Invalid group '%s' in the randomization list", entry.Group)
+		}
+		entry.Used = true
+		return grp, nil
+	}
+
+	if stratum != "" {
+		return -1, fmt.Errorf("The randomization list has no remaining entries for stratum '%s'", stratum)
+	}
+	return -1, fmt.Errorf("The randomization list has no remaining entries")
+}
+
+// listIsStratified returns true if any entry of the list belongs to a
+// stratum.
+func listIsStratified(list []*ListEntry) bool {
+
+	for _, entry := range list {
+		if entry.Stratum != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// listStratum returns the stratum of a subject for a stratified
+// randomization list.  The stratum consists of the site (if the
+// project has sites), followed by the values of the categorical
+// variables, separated by commas.
+func listStratum(M *map[string]string, site string, project *Project) string {
+
+	var parts []string
+	if len(project.Sites) > 0 {
+		parts = append(parts, site)
+	}
+	for _, va := range project.Variables {
+		if va.Type != "Continuous" {
+			parts = append(parts, (*M)[va.Name])
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// listStrata returns all strata that may be used in a stratified
+// randomization list for the project.
+func listStrata(project *Project) []string {
+
+	var factors [][]string
+	if len(project.Sites) > 0 {
+		factors = append(factors, project.Sites)
+	}
+	for _, va := range project.Variables {
+		if va.Type != "Continuous" {
+			factors = append(factors, va.Levels)
+		}
+	}
+
+	strata := [][]string{{}}
+	for _, levels := range factors {
+		var next [][]string
+		for _, s := range strata {
+			for _, x := range levels {
+				t := make([]string, len(s), len(s)+1)
+				copy(t, s)
+				next = append(next, append(t, x))
+			}
+		}
+		strata = next
+	}
+
+	keys := make([]string, len(strata))
+	for i, s := range strata {
+		keys[i] = strings.Join(s, ",")
+	}
+
+	return keys
+}
+
+// parseList reads a randomization list in CSV format.  The first row
+// contains the column names, of which "Group" is required, and
+// "Stratum" and "Block" are optional.  Other columns are ignored.
+func parseList(rd io.Reader, project *Project) ([]*ListEntry, error) {
+
+	records, err := csv.NewReader(rd).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("the file is not a valid CSV file: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("the list does not contain any entries.")
+	}
+
+	grpCol, stratumCol, blockCol := -1, -1, -1
+	for j, x := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(x)) {
+		case "group":
+			grpCol = j
+		case "stratum":
+			stratumCol = j
+		case "block":
+			blockCol = j
+		}
+	}
+	if grpCol == -1 {
+		return nil, fmt.Errorf("the list does not have a column named 'Group'.")
+	}
+
+	strata := make(map[string]bool)
+	for _, s := range listStrata(project) {
+		strata[s] = true
+	}
+
+	var list []*ListEntry
+	for i, rec := range records[1:] {
+		entry := &ListEntry{Group: strings.TrimSpace(rec[grpCol])}
+		if getIndex(project.GroupNames, entry.Group) == -1 {
+			return nil, fmt.Errorf("row %d of the list contains the unknown group '%s'.", i+2, entry.Group)
+		}
+		if stratumCol != -1 {
+			entry.Stratum = strings.Join(cleanSplit(rec[stratumCol], ","), ",")
+			if entry.Stratum != "" && !strata[entry.Stratum] {
+				return nil, fmt.Errorf("row %d of the list contains the unknown stratum '%s'.", i+2, entry.Stratum)
+			}
+		}
+		if blockCol != -1 {
+			entry.Block = strings.TrimSpace(rec[blockCol])
+		}
+		list = append(list, entry)
+	}
+
+	if listIsStratified(list) {
+		for i, entry := range list {
+			if entry.Stratum == "" {
+				return nil, fmt.Errorf("row %d of the list has no stratum, but other rows do.", i+2)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// generateList returns a randomization list consisting of numBlocks
+// permuted blocks within each stratum.  If stratified is false, the
+// list has a single sequence of blocks.
+func generateList(project *Project, sizes []int, numBlocks int, stratified bool, rgen *rand.Rand) ([]*ListEntry, error) {
+
+	strata := []string{""}
+	if stratified {
+		strata = listStrata(project)
+	}
+
+	gen := Project{BlockSizes: sizes, SamplingRates: project.SamplingRates}
+
+	var list []*ListEntry
+	for _, stratum := range strata {
+		for k := 0; k < numBlocks; k++ {
+			block, err := newBlock(&gen, rgen)
+			if err != nil {
+				return nil, err
+			}
+			for _, grp := range block.Sequence {
+				entry := &ListEntry{
+					Stratum: stratum,
+					Block:   strconv.Itoa(k + 1),
+					Group:   project.GroupNames[grp],
+				}
+				list = append(list, entry)
+			}
+		}
+	}
+
+	return list, nil
+}
+
+// writeList writes a randomization list in CSV format, in the format
+// read by parseList.
+func writeList(w io.Writer, list []*ListEntry) error {
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"Sequence", "Stratum", "Block", "Group", "Used"}); err != nil {
+		return err
+	}
+	for i, entry := range list {
+		used := "No"
+		if entry.Used {
+			used = "Yes"
+		}
+		row := []string{strconv.Itoa(i + 1), entry.Stratum, entry.Block, entry.Group, used}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// getListProject loads a project that uses a randomization list, and
+// checks that the current user is its owner.  If the checks fail, a
+// message is displayed and nil is returned.
+func getListProject(w http.ResponseWriter, r *http.Request, pkey string) *Project {
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "getListProject: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return nil
+	}
+
+	// The list reveals the future assignments, so only the owner
+	// may see it.
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage its randomization list."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	if project.Method != "List" {
+		msg := "This project does not use a randomization list."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return nil
+	}
+
+	return project
+}
+
+// randomizationListPage displays a summary of the randomization list
+// of a project, with forms to upload or generate a list.
+func randomizationListPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getListProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	// The number of entries and remaining entries within each
+	// stratum, in order of first appearance.
+	var summary [][]string
+	total := make(map[string]int)
+	remaining := make(map[string]int)
+	var strata []string
+	for _, entry := range project.List {
+		if _, ok := total[entry.Stratum]; !ok {
+			strata = append(strata, entry.Stratum)
+		}
+		total[entry.Stratum]++
+		if !entry.Used {
+			remaining[entry.Stratum]++
+		}
+	}
+	for _, s := range strata {
+		label := s
+		if label == "" {
+			label = "All subjects"
+		}
+		summary = append(summary, []string{label, strconv.Itoa(total[s]), strconv.Itoa(remaining[s])})
+	}
+
+	tvals := struct {
+		User          string
+		LoggedIn      bool
+		ProjectName   string
+		Pkey          string
+		AnyList       bool
+		Summary       [][]string
+		CanReplace    bool
+		StratumFormat string
+	}{
+		User:          user.String(),
+		LoggedIn:      user != nil,
+		ProjectName:   project.Name,
+		Pkey:          pkey,
+		AnyList:       len(project.List) > 0,
+		Summary:       summary,
+		CanReplace:    project.NumAssignments == 0,
+		StratumFormat: strings.Join(listStrata(project), "; "),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "randomization_list.html", tvals); err != nil {
+		log.Errorf(ctx, "randomizationListPage failed to execute template: %v", err)
+	}
+}
+
+// uploadList replaces the randomization list of a project with an
+// uploaded list.
+func uploadList(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getListProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	if project.NumAssignments > 0 {
+		msg := "The randomization list cannot be replaced after subjects have been assigned."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	file, _, err := r.FormFile("list")
+	if err != nil {
+		msg := "Please select a file containing the randomization list."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	defer file.Close()
+
+	list, err := parseList(file, project)
+	if err != nil {
+		msg := fmt.Sprintf("The randomization list was not uploaded: %v", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	storeList(w, r, project, pkey, list)
+}
+
+// generateListPage replaces the randomization list of a project with
+// a list of permuted blocks.
+func generateListPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project := getListProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	if project.NumAssignments > 0 {
+		msg := "The randomization list cannot be replaced after subjects have been assigned."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	sizes, err := parseBlockSizes(r.FormValue("block_sizes"), project.SamplingRates)
+	if err != nil {
+		msg := fmt.Sprintf("The randomization list was not generated: %v", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	numBlocks, err := strconv.Atoi(r.FormValue("num_blocks"))
+	if err != nil || numBlocks < 1 {
+		msg := "The randomization list was not generated: the number of blocks must be a positive whole number."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	seed, err := newSeed()
+	if err != nil {
+		log.Errorf(ctx, "generateListPage: %v", err)
+		ServeError(ctx, w, err)
+		return
+	}
+	rgen := rand.New(rand.NewSource(seed))
+
+	list, err := generateList(project, sizes, numBlocks, r.FormValue("stratified") == "yes", rgen)
+	if err != nil {
+		msg := fmt.Sprintf("The randomization list was not generated: %v", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	storeList(w, r, project, pkey, list)
+}
+
+// storeList stores a new randomization list in the project, and
+// displays a confirmation message.
+func storeList(w http.ResponseWriter, r *http.Request, project *Project, pkey string, list []*ListEntry) {
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	project.List = list
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "storeList: %v", err)
+		msg := "A datastore error occured, the randomization list was not stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("The randomization list with %d entries has been stored.", len(list))
+	rmsg := "Return to randomization list"
+	messagePage(w, r, user, msg, rmsg, "/randomization_list?pkey="+pkey)
+}
+
+// exportList writes the randomization list of a project in CSV
+// format, for archiving.
+func exportList(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	pkey := r.FormValue("pkey")
+
+	project := getListProject(w, r, pkey)
+	if project == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=randomization_list.csv")
+
+	if err := writeList(w, project.List); err != nil {
+		log.Errorf(ctx, "exportList: %v", err)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine"
-	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/user"
 )
@@ -44,17 +43,52 @@ func init() {
 	http.HandleFunc("/project_dashboard", requireLogin(projectDashboard))
 	http.HandleFunc("/edit_sharing", requireLogin(editSharing))
 	http.HandleFunc("/edit_sharing_confirm", requireLogin(editSharingConfirm))
+	http.HandleFunc("/edit_sites", requireLogin(editSites))
+	http.HandleFunc("/edit_sites_confirm", requireLogin(editSitesConfirm))
 
 	// Treatment assignment pages
 	http.HandleFunc("/assign_treatment_input", requireLogin(assignTreatmentInput))
 	http.HandleFunc("/assign_treatment_confirm", requireLogin(assignTreatmentConfirm))
 	http.HandleFunc("/assign_treatment", requireLogin(assignTreatment))
+	http.HandleFunc("/assign_batch_input", requireLogin(assignBatchInput))
+	http.HandleFunc("/assign_batch_confirm", requireLogin(assignBatchConfirm))
+	http.HandleFunc("/assign_batch", requireLogin(assignBatchPage))
 
 	http.HandleFunc("/view_statistics", requireLogin(viewStatistics))
 	http.HandleFunc("/view_comments", requireLogin(viewComments))
 	http.HandleFunc("/add_comment", requireLogin(addComment))
 	http.HandleFunc("/confirm_add_comment", requireLogin(confirmAddComment))
 	http.HandleFunc("/view_complete_data", requireLogin(viewCompleteData))
+	http.HandleFunc("/replay_assignments", requireLogin(replayAssignmentsPage))
+	http.HandleFunc("/simulate", requireLogin(simulatePage))
+	http.HandleFunc("/simulation_report", requireLogin(simulationReport))
+	http.HandleFunc("/simulation_csv", requireLogin(simulationCSV))
+	http.HandleFunc("/randomization_test", requireLogin(randomizationTestPage))
+	http.HandleFunc("/randomization_test_result", requireLogin(randomizationTestResult))
+	http.HandleFunc("/balance_diagnostics", requireLogin(balanceDiagnosticsFile))
+	http.HandleFunc("/verify_aggregates", requireLogin(verifyAggregates))
+	http.HandleFunc("/repair_aggregates", requireLogin(repairAggregatesPage))
+	http.HandleFunc("/record_outcome", requireLogin(recordOutcome))
+	http.HandleFunc("/record_outcome_confirm", requireLogin(recordOutcomeConfirm))
+	http.HandleFunc("/fill_missing", requireLogin(fillMissing))
+	http.HandleFunc("/fill_missing_confirm", requireLogin(fillMissingConfirm))
+
+	// Randomization list pages
+	http.HandleFunc("/randomization_list", requireLogin(randomizationListPage))
+	http.HandleFunc("/upload_list", requireLogin(uploadList))
+	http.HandleFunc("/generate_list", requireLogin(generateListPage))
+	http.HandleFunc("/export_list", requireLogin(exportList))
+
+	// Multi-stage pages
+	http.HandleFunc("/stages", requireLogin(stagesPage))
+	http.HandleFunc("/add_stage", requireLogin(addStage))
+	http.HandleFunc("/rerandomize", requireLogin(rerandomizeInput))
+	http.HandleFunc("/rerandomize_confirm", requireLogin(rerandomize))
+
+	// Cluster randomization pages
+	http.HandleFunc("/clusters", requireLogin(clustersPage))
+	http.HandleFunc("/cluster_values", requireLogin(clusterValues))
+	http.HandleFunc("/randomize_clusters", requireLogin(randomizeClustersPage))
 
 	// Remove subject pages
 	http.HandleFunc("/remove_subject", requireLogin(removeSubject))
@@ -86,17 +120,11 @@ func checkAccess(ctx context.Context, user *user.User, pkey string, w *http.Resp
 	}
 
 	// Otherwise, check if the project is shared with the user.
-	key := datastore.NewKey(ctx, "SharingByUser", userName, 0, nil)
-	var sbuser SharingByUser
-	err := datastore.Get(ctx, key, &sbuser)
-	if err == datastore.ErrNoSuchEntity {
-		checkAccessFailed(ctx, nil, w, r, user)
-		return false
-	} else if err != nil {
+	L, err := repository.GetSharedProjects(ctx, userName)
+	if err != nil {
 		checkAccessFailed(ctx, &err, w, r, user)
 		return false
 	}
-	L := cleanSplit(sbuser.Projects, ",")
 	for _, x := range L {
 		if pkey == x {
 			return true
@@ -0,0 +1,147 @@
+package randomization
+
+import (
+	"fmt"
+	"math"
+)
+
+// minimumTies returns the positions of the smallest values in x.
+func minimumTies(x []float64) []int {
+
+	best := math.Inf(1)
+	var ties []int
+	for i, v := range x {
+		switch {
+		case v < best-1e-9:
+			best = v
+			ties = []int{i}
+		case v < best+1e-9:
+			ties = append(ties, i)
+		}
+	}
+
+	return ties
+}
+
+// sizeGuesses returns the groups that would be guessed for the next
+// subject at the given site by the convergence strategy of Blackwell
+// and Hodges (Annals of Mathematical Statistics 28, 1957), which
+// guesses the group with the fewest subjects relative to its sampling
+// rate.  In a multi-center trial, the group sizes within the site are
+// used.  If several groups are tied, each is guessed with equal
+// probability.
+func sizeGuesses(project *Project, site string) []int {
+
+	counts := project.Assignments
+	if site != "" {
+		_, counts = siteAggregates(project, site)
+	}
+
+	adj := make([]float64, len(counts))
+	for i, n := range counts {
+		adj[i] = float64(n) / project.SamplingRates[i]
+	}
+
+	return minimumTies(adj)
+}
+
+// guessRecord accumulates the expected numbers of correct guesses by
+// one guessing strategy.
+type guessRecord struct {
+	Strategy string
+	Num      int
+
+	// The expected number of correct guesses, and the expected
+	// number if the same guesses were made under complete
+	// randomization.
+	Correct float64
+	Random  float64
+}
+
+// add records a guess of one of the groups in ties, each with equal
+// probability, for a subject who was assigned to group grp.
+func (g *guessRecord) add(ties []int, grp int, rates []float64) {
+
+	total := 0.0
+	for _, r := range rates {
+		total += r
+	}
+
+	p := 1 / float64(len(ties))
+	for _, i := range ties {
+		if i == grp {
+			g.Correct += p
+		}
+		g.Random += p * rates[i] / total
+	}
+	g.Num++
+}
+
+// predictabilityStats returns the predictability of the stored
+// assignments, for an observer who knows all previous assignments
+// and guesses the group of each new subject.  The convergence
+// strategy guesses the group with the fewest subjects, and the
+// minimization strategy, used if the project has variables, guesses
+// the group with the smallest minimization score given the subject's
+// values.  For each strategy, the number of assignments, the expected
+// number and proportion of correct guesses, the expected proportion
+// under complete randomization with the same sampling rates, and the
+// difference between the two proportions (the selection bias of
+// Blackwell and Hodges) are returned.  The assignments are considered
+// in the order that they were made, with the groups to which the
+// subjects were originally assigned.
+func predictabilityStats(project *Project) [][]string {
+
+	if !project.StoreRawData || len(project.RawData) == 0 {
+		return nil
+	}
+
+	fresh := initialProject(project)
+	fresh.StoreRawData = false
+
+	conv := &guessRecord{Strategy: "Convergence (fewest subjects)"}
+	mini := &guessRecord{Strategy: "Minimization (smallest score for the subject)"}
+
+	for _, rec := range project.RawData {
+		grp := getIndex(project.GroupNames, rec.AssignedGroup)
+		if grp == -1 {
+			continue
+		}
+		data := assignedValues(project, rec)
+
+		conv.add(sizeGuesses(fresh, rec.Site), grp, project.SamplingRates)
+
+		if len(project.Variables) > 0 {
+			M := make(map[string]string)
+			for j, va := range project.Variables {
+				M[va.Name] = data[j]
+			}
+			if scores, err := minimizationScores(&M, rec.Site, fresh); err == nil {
+				mini.add(minimumTies(scores), grp, project.SamplingRates)
+			}
+		}
+
+		sh := &DataRecord{Data: data, Site: rec.Site, CurrentGroup: rec.AssignedGroup, Included: true}
+		addToAggregate(sh, fresh)
+	}
+
+	guesses := []*guessRecord{conv}
+	if mini.Num > 0 {
+		guesses = append(guesses, mini)
+	}
+
+	var stats [][]string
+	for _, g := range guesses {
+		n := float64(g.Num)
+		stats = append(stats, []string{
+			g.Strategy,
+			fmt.Sprintf("%d", g.Num),
+			fmt.Sprintf("%.1f", g.Correct),
+			fmt.Sprintf("%.3f", g.Correct/n),
+			fmt.Sprintf("%.3f", g.Random/n),
+			fmt.Sprintf("%+.3f", (g.Correct-g.Random)/n),
+		})
+	}
+
+	return stats
+}
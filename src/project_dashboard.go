@@ -46,6 +46,8 @@ func projectDashboard(w http.ResponseWriter, r *http.Request) {
 		StoreRawData    string
 		Open            string
 		AnyVars         bool
+		Method          string
+		AnyMissing      bool
 	}{
 		User:            user.String(),
 		LoggedIn:        user != nil,
@@ -55,6 +57,13 @@ func projectDashboard(w http.ResponseWriter, r *http.Request) {
 		Pkey:            pkey,
 		ShowEditSharing: owner == user.String(),
 		Owner:           owner,
+		Method:          proj.Method,
+	}
+
+	for _, va := range proj.Variables {
+		if va.AllowMissing && proj.StoreRawData {
+			tvals.AnyMissing = true
+		}
 	}
 
 	if proj.StoreRawData {
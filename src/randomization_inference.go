@@ -0,0 +1,459 @@
+package randomization
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// maxRerandomizedAssignments is the largest total number of
+// assignments (re-randomizations times subjects) in one randomization
+// test.  Each assignment takes a few microseconds with minimization,
+// more with many variables, so that the test completes within a few
+// seconds.
+const maxRerandomizedAssignments = 500000
+
+// RandomizationTest contains the result of a randomization test of the
+// treatment effect.
+type RandomizationTest struct {
+	NumSubjects         int
+	NumOutcomes         int
+	NumRerandomizations int
+	Seed                int64
+
+	// The observed value of the test statistic, and the number of
+	// re-randomizations with a value at least as large.
+	Statistic  float64
+	NumExtreme int
+	PValue     float64
+
+	// The number of outcomes and their mean and standard deviation
+	// within each group.
+	GroupStats [][]string
+
+	// Changes to the subjects that could not be applied in the
+	// re-randomizations because their times were not recorded.
+	Warnings []string
+}
+
+// rerandomizationAllowed returns true if the assignments of the
+// project can be re-run for a randomization test.  Randomization lists
+// and cluster allocations cannot be regenerated from the stored data,
+// and response-adaptive methods depend on the times at which the
+// outcomes were recorded.
+func rerandomizationAllowed(project *Project) bool {
+
+	switch project.Method {
+	case "List", "Cluster", "Thompson", "PlayTheWinner":
+		return false
+	}
+	return true
+}
+
+// parseOutcomes reads the outcomes of the subjects in CSV format.  The
+// first row contains the column names, of which "Subject id" and
+// "Outcome" are required.  Other columns are ignored, as are rows with
+// a blank outcome.
+func parseOutcomes(rd io.Reader, project *Project) (map[string]float64, error) {
+
+	records, err := csv.NewReader(rd).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("the file is not a valid CSV file: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, fmt.Errorf("the file does not contain any outcomes.")
+	}
+
+	idCol, outCol := -1, -1
+	for j, x := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(x)) {
+		case "subject id":
+			idCol = j
+		case "outcome":
+			outCol = j
+		}
+	}
+	if idCol == -1 || outCol == -1 {
+		return nil, fmt.Errorf("the file must have columns named 'Subject id' and 'Outcome'.")
+	}
+
+	known := make(map[string]bool)
+	for _, rec := range project.RawData {
+		known[rec.SubjectId] = true
+	}
+
+	outcomes := make(map[string]float64)
+	for i, rec := range records[1:] {
+		id := strings.TrimSpace(rec[idCol])
+		x := strings.TrimSpace(rec[outCol])
+		if x == "" {
+			continue
+		}
+		if !known[id] {
+			return nil, fmt.Errorf("row %d of the file contains the unknown subject '%s'.", i+2, id)
+		}
+		if _, ok := outcomes[id]; ok {
+			return nil, fmt.Errorf("subject '%s' has more than one outcome.", id)
+		}
+		y, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the outcome '%s' in row %d of the file is not a number.", x, i+2)
+		}
+		outcomes[id] = y
+	}
+
+	return outcomes, nil
+}
+
+// effectStatistic returns the test statistic for the outcomes y of the
+// subjects in the given groups.  With two groups, the statistic is the
+// absolute difference between the group means, otherwise it is the
+// between-group sum of squares.  Groups without outcomes are ignored.
+func effectStatistic(groups []int, y []float64, numGroups int) float64 {
+
+	n := make([]float64, numGroups)
+	sum := make([]float64, numGroups)
+	var total float64
+	for k, grp := range groups {
+		n[grp]++
+		sum[grp] += y[k]
+		total += y[k]
+	}
+
+	if numGroups == 2 {
+		if n[0] == 0 || n[1] == 0 {
+			return 0
+		}
+		return math.Abs(sum[0]/n[0] - sum[1]/n[1])
+	}
+
+	mean := total / float64(len(y))
+	ss := 0.0
+	for i := range n {
+		if n[i] > 0 {
+			d := sum[i]/n[i] - mean
+			ss += n[i] * d * d
+		}
+	}
+
+	return ss
+}
+
+// reassignSubjects re-runs the assignment of all stored subjects,
+// starting from an empty copy of the project.  The events of the
+// original trial are applied in the order that they were made, see
+// replayEvents, so that each subject is assigned with the values of
+// the variables that were known at the time, and group changes, filled
+// in values and removals are applied to the aggregate data as they
+// were.  The allocator is called directly with rgen, and the subjects
+// of a batch are assigned jointly with seeds drawn from rgen.  The
+// position of the new group of each stored subject is returned.
+func reassignSubjects(project *Project, events []*replayEvent, rgen *rand.Rand) ([]int, error) {
+
+	alloc, err := getAllocator(project.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := initialProject(project)
+	groups := make([]int, len(project.RawData))
+	batchGroups := make(map[int][]int)
+
+	assign := func(ev *replayEvent, data []string) (int, error) {
+		rec := ev.Rec
+		if rec.Batch > 0 && rec.Batch <= len(project.Batches) {
+			bg, ok := batchGroups[rec.Batch]
+			if !ok {
+				bg = replayBatch(project, fresh, rec.Batch, rgen.Int63())
+				if bg == nil {
+					return -1, fmt.Errorf("batch %d could not be re-randomized", rec.Batch)
+				}
+				batchGroups[rec.Batch] = bg
+			}
+			groups[ev.Pos] = bg[getIndex(project.Batches[rec.Batch-1].SubjectIds, rec.SubjectId)]
+			return groups[ev.Pos], nil
+		}
+
+		M := make(map[string]string)
+		for j, va := range project.Variables {
+			M[va.Name] = data[j]
+		}
+		ii, err := alloc.Assign(&M, rec.Site, fresh, rgen)
+		if err != nil {
+			return -1, err
+		}
+		groups[ev.Pos] = ii
+		return ii, nil
+	}
+
+	if err := applyEvents(project, fresh, events, assign, nil); err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// randomizationTest tests for a treatment effect on the given outcomes
+// by re-randomization.  The assignment process is re-run nrep times
+// with the observed sequence of subjects, using a random number
+// generator with the given seed, and the p-value is the proportion of
+// the re-randomizations, counting the observed assignment, whose test
+// statistic is at least as large as the observed statistic.  The
+// subjects are analysed in the groups to which they were originally
+// assigned.
+func randomizationTest(project *Project, outcomes map[string]float64, nrep int, seed int64) (*RandomizationTest, error) {
+
+	numGroups := len(project.GroupNames)
+
+	// The positions within RawData of the subjects with outcomes,
+	// and their outcomes and assigned groups.
+	var pos, observed []int
+	var y []float64
+	for i, rec := range project.RawData {
+		x, ok := outcomes[rec.SubjectId]
+		if !ok {
+			continue
+		}
+		grp := getIndex(project.GroupNames, rec.AssignedGroup)
+		if grp == -1 {
+			return nil, fmt.Errorf("subject '%s' has the unknown group '%s'", rec.SubjectId, rec.AssignedGroup)
+		}
+		pos = append(pos, i)
+		observed = append(observed, grp)
+		y = append(y, x)
+	}
+	if len(y) < 2 {
+		return nil, fmt.Errorf("at least two subjects must have outcomes")
+	}
+
+	rt := &RandomizationTest{
+		NumSubjects:         len(project.RawData),
+		NumOutcomes:         len(y),
+		NumRerandomizations: nrep,
+		Seed:                seed,
+		Statistic:           effectStatistic(observed, y, numGroups),
+	}
+
+	var events []*replayEvent
+	events, rt.Warnings = replayEvents(project)
+
+	rgen := rand.New(rand.NewSource(seed))
+	sim := make([]int, len(pos))
+	for r := 0; r < nrep; r++ {
+		groups, err := reassignSubjects(project, events, rgen)
+		if err != nil {
+			return nil, err
+		}
+		for k, i := range pos {
+			sim[k] = groups[i]
+		}
+		if effectStatistic(sim, y, numGroups) >= rt.Statistic-1e-12 {
+			rt.NumExtreme++
+		}
+	}
+	rt.PValue = float64(rt.NumExtreme+1) / float64(nrep+1)
+
+	for i, g := range project.GroupNames {
+		var n, sum, sumsq float64
+		for k, grp := range observed {
+			if grp == i {
+				n++
+				sum += y[k]
+				sumsq += y[k] * y[k]
+			}
+		}
+		mean, sd := moments(n, sum, sumsq)
+		row := []string{g, fmt.Sprintf("%.0f", n), "-"}
+		if n > 0 {
+			row[2] = fmt.Sprintf("%.3f (%.3f)", mean, sd)
+		}
+		rt.GroupStats = append(rt.GroupStats, row)
+	}
+
+	return rt, nil
+}
+
+// randomizationTestPage displays a form to upload the outcomes for a
+// randomization test.
+func randomizationTestPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "randomizationTestPage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if !project.StoreRawData || !rerandomizationAllowed(project) {
+		msg := "A randomization test is only available for projects in which the complete data are stored, and which do not use a randomization list, cluster randomization or response-adaptive randomization."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		NumSubjects int
+		MaxTotal    int
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		NumSubjects: len(project.RawData),
+		MaxTotal:    maxRerandomizedAssignments,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "randomization_test.html", tvals); err != nil {
+		log.Errorf(ctx, "randomizationTestPage failed to execute template: %v", err)
+	}
+}
+
+// randomizationTestResult performs a randomization test using the
+// uploaded outcomes, and displays the result.
+func randomizationTestResult(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "randomizationTestResult: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if !project.StoreRawData || !rerandomizationAllowed(project) {
+		msg := "A randomization test is not available for this project."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	nrep, err := strconv.Atoi(strings.TrimSpace(r.FormValue("rerandomizations")))
+	if err != nil || nrep < 1 {
+		msg := "The number of re-randomizations must be a positive whole number."
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+	if len(project.RawData) == 0 {
+		msg := "No subjects have been assigned."
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+	if nrep > maxRerandomizedAssignments/len(project.RawData) {
+		msg := fmt.Sprintf("The number of re-randomizations times the number of subjects may not exceed %d.", maxRerandomizedAssignments)
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+
+	var seed int64
+	if s := strings.TrimSpace(r.FormValue("seed")); s != "" {
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			msg := "The seed must be a whole number."
+			rmsg := "Return to randomization test"
+			messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+			return
+		}
+	} else {
+		seed, err = newSeed()
+		if err != nil {
+			log.Errorf(ctx, "randomizationTestResult: %v", err)
+			ServeError(ctx, w, err)
+			return
+		}
+	}
+
+	file, _, err := r.FormFile("outcomes")
+	if err != nil {
+		msg := "Please select a file containing the outcomes."
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+	defer file.Close()
+
+	outcomes, err := parseOutcomes(file, project)
+	if err != nil {
+		msg := fmt.Sprintf("The outcomes could not be read: %v", err)
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+
+	rt, err := randomizationTest(project, outcomes, nrep, seed)
+	if err != nil {
+		msg := fmt.Sprintf("The randomization test failed: %v.", err)
+		rmsg := "Return to randomization test"
+		messagePage(w, r, user, msg, rmsg, "/randomization_test?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		GroupNames  []string
+		Test        *RandomizationTest
+		Statistic   string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		GroupNames:  project.GroupNames,
+		Test:        rt,
+		Statistic:   "Between-group sum of squares",
+	}
+	if len(project.GroupNames) == 2 {
+		tvals.Statistic = "Absolute difference between the group means"
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "randomization_test_result.html", tvals); err != nil {
+		log.Errorf(ctx, "randomizationTestResult failed to execute template: %v", err)
+	}
+}
@@ -194,6 +194,7 @@ func removeSubjectCompleted(w http.ResponseWriter, r *http.Request) {
 	for _, rec := range proj.RawData {
 		if rec.SubjectId == subjectId {
 			rec.Included = false
+			rec.RemovedTime = time.Now()
 			removeRec = rec
 			found = true
 		}
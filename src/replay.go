@@ -0,0 +1,456 @@
+package randomization
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// ReplayResult is the result of replaying the assignment of one
+// subject in one stage.
+type ReplayResult struct {
+	SubjectId     string
+	Stage         string
+	RecordedGroup string
+	ReplayedGroup string
+	Status        string
+}
+
+// replayEvent is an assignment, group change, filled in value,
+// outcome, assignment in a later stage or removal of one subject.  Pos
+// is the position of the subject's record within the project's
+// RawData.
+type replayEvent struct {
+	Time  time.Time
+	Rec   *DataRecord
+	Kind  string
+	Group string
+	Fill  ValueFill
+	Stage *StageAssignment
+	Pos   int
+}
+
+// byTime sorts events by their time, keeping the original order of
+// simultaneous events.
+type byTime []*replayEvent
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Time.Before(a[j].Time) }
+
+// newSeed returns a non-zero seed for the random number generator,
+// obtained from a cryptographically secure source.
+func newSeed() (int64, error) {
+
+	for {
+		var b [8]byte
+		if _, err := crand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		seed := int64(binary.LittleEndian.Uint64(b[:]))
+		if seed != 0 {
+			return seed, nil
+		}
+	}
+}
+
+// initialProject returns a copy of the project as it was before any
+// subjects were assigned.  The copy shares the project settings, but
+// has its own aggregate data and allocation state.
+func initialProject(project *Project) *Project {
+
+	fresh := *project
+	fresh.Assignments = make([]int, len(project.GroupNames))
+	fresh.Data = newAggregateData(project)
+	fresh.Blocks = nil
+	if project.StratumAssignments != nil {
+		fresh.StratumAssignments = make(map[string][]int)
+	}
+	if project.SiteData != nil {
+		fresh.SiteData = make(map[string][][][]float64)
+		fresh.SiteAssignments = make(map[string][]int)
+	}
+	fresh.RawData = nil
+	fresh.NumAssignments = 0
+
+	if project.OutcomeStats != nil {
+		fresh.OutcomeStats = newOutcomeStats(project)
+	}
+
+	fresh.Stages = make([]*Stage, len(project.Stages))
+	for i, st := range project.Stages {
+		s := *st
+		s.Assignments = make([]int, len(st.GroupNames))
+		s.Data = newAggregateData(stageProject(project, st))
+		fresh.Stages[i] = &s
+	}
+
+	fresh.List = make([]*ListEntry, len(project.List))
+	for i, entry := range project.List {
+		e := *entry
+		e.Used = false
+		fresh.List[i] = &e
+	}
+
+	return &fresh
+}
+
+// replayEvents returns the assignments, group changes, filled in
+// values, outcomes, assignments in later stages and removals of the
+// stored subjects, sorted by time.  The returned warnings describe
+// changes that cannot be replayed because their times were not
+// recorded.
+func replayEvents(project *Project) ([]*replayEvent, []string) {
+
+	var events []*replayEvent
+	var warnings []string
+
+	for i, rec := range project.RawData {
+		events = append(events, &replayEvent{Time: rec.AssignedTime, Rec: rec, Kind: "assign", Pos: i})
+
+		group := rec.AssignedGroup
+		for _, e := range rec.Edits {
+			events = append(events, &replayEvent{Time: e.Time, Rec: rec, Kind: "edit", Group: e.Group})
+			group = e.Group
+		}
+		if group != rec.CurrentGroup {
+			warnings = append(warnings, fmt.Sprintf("The time at which the group of subject '%s' was changed was not recorded.", rec.SubjectId))
+		}
+
+		for _, f := range rec.Fills {
+			events = append(events, &replayEvent{Time: f.Time, Rec: rec, Kind: "fill", Fill: f})
+		}
+
+		if rec.HasOutcome {
+			events = append(events, &replayEvent{Time: rec.OutcomeTime, Rec: rec, Kind: "outcome"})
+		}
+
+		for _, sa := range rec.StageAssignments {
+			events = append(events, &replayEvent{Time: sa.Time, Rec: rec, Kind: "stage", Stage: sa, Pos: i})
+		}
+
+		if !rec.Included {
+			if rec.RemovedTime.IsZero() {
+				warnings = append(warnings, fmt.Sprintf("The time at which subject '%s' was removed was not recorded.", rec.SubjectId))
+			} else {
+				events = append(events, &replayEvent{Time: rec.RemovedTime, Rec: rec, Kind: "remove"})
+			}
+		}
+	}
+	sort.Stable(byTime(events))
+
+	return events, warnings
+}
+
+// applyEvents applies the events, in order, to the copy fresh of the
+// project, see initialProject.  For each assignment, assign is called
+// with the values of the variables that were known at the time, before
+// the subject is added to the aggregate data of the copy, and returns
+// the position of the group to which the subject is added.  Later
+// changes are applied to the subject in the copy at the times that
+// they were made.  The recorded assignments in later stages are added
+// to the copy, after calling stage, if it is not nil.
+func applyEvents(project, fresh *Project, events []*replayEvent, assign func(ev *replayEvent, data []string) (int, error), stage func(ev *replayEvent)) error {
+
+	// The records used to update the aggregate data of the copy,
+	// with the group at the current point of the replay.
+	shadow := make(map[*DataRecord]*DataRecord)
+
+	for _, ev := range events {
+		rec := ev.Rec
+		switch ev.Kind {
+		case "assign":
+			data := assignedValues(project, rec)
+			ii, err := assign(ev, data)
+			if err != nil {
+				return err
+			}
+			sh := &DataRecord{Data: data, Site: rec.Site, CurrentGroup: fresh.GroupNames[ii], Included: true}
+			shadow[rec] = sh
+			addToAggregate(sh, fresh)
+			fresh.NumAssignments++
+		case "edit":
+			sh := shadow[rec]
+			removeFromAggregate(sh, fresh)
+			sh.CurrentGroup = ev.Group
+			addToAggregate(sh, fresh)
+		case "fill":
+			sh := shadow[rec]
+			for j, va := range project.Variables {
+				if va.Name == ev.Fill.Variable {
+					_ = fillValue(fresh, sh, j, ev.Fill.Value)
+				}
+			}
+		case "outcome":
+			sh := shadow[rec]
+			sh.HasOutcome = true
+			sh.Outcome = rec.Outcome
+			updateOutcomeStats(fresh, getIndex(fresh.GroupNames, sh.CurrentGroup), sh.Outcome, 1)
+		case "stage":
+			if stage != nil {
+				stage(ev)
+			}
+			sh := shadow[rec]
+			sh.StageAssignments = append(sh.StageAssignments, ev.Stage)
+			if sh.Included {
+				_ = updateStage(fresh, ev.Stage, 1)
+			}
+		case "remove":
+			removeFromAggregate(shadow[rec], fresh)
+			shadow[rec].Included = false
+			fresh.NumAssignments--
+		}
+	}
+
+	return nil
+}
+
+// replayAssignments re-runs the sequence of treatment assignments
+// using the stored subject data and seeds, starting from an empty
+// copy of the project.  Group changes and removals are applied at the
+// times that they were made, so that each assignment is replayed
+// with the aggregate data that were in place when it was originally
+// made.  The assignments in later stages are replayed in the same
+// way, and their results follow the subject's first assignment.  The
+// returned warnings describe changes that could not be replayed
+// because their times were not recorded.
+func replayAssignments(project *Project) ([]*ReplayResult, []string) {
+
+	events, warnings := replayEvents(project)
+
+	var results []*ReplayResult
+	first := make([]*ReplayResult, len(project.RawData))
+	later := make(map[*StageAssignment]*ReplayResult)
+	for i, rec := range project.RawData {
+		first[i] = &ReplayResult{SubjectId: rec.SubjectId, Stage: stageName(project, -1), RecordedGroup: rec.AssignedGroup}
+		results = append(results, first[i])
+		for _, sa := range rec.StageAssignments {
+			res := &ReplayResult{SubjectId: rec.SubjectId, Stage: stageName(project, sa.Stage), RecordedGroup: sa.Group}
+			later[sa] = res
+			results = append(results, res)
+		}
+	}
+
+	fresh := initialProject(project)
+
+	// The replayed groups of the subjects in each batch.
+	batchGroups := make(map[int][]int)
+
+	assign := func(ev *replayEvent, data []string) (int, error) {
+		rec := ev.Rec
+		res := first[ev.Pos]
+
+		switch {
+		case rec.Seed == 0:
+			res.Status = "Seed not recorded"
+		case rec.Batch > 0:
+			// The subjects of a batch are replayed
+			// jointly, before any of them are added.
+			groups, ok := batchGroups[rec.Batch]
+			if !ok {
+				if rec.Batch <= len(project.Batches) {
+					groups = replayBatch(project, fresh, rec.Batch, project.Batches[rec.Batch-1].Seed)
+				}
+				batchGroups[rec.Batch] = groups
+			}
+			k := -1
+			if groups != nil {
+				k = getIndex(project.Batches[rec.Batch-1].SubjectIds, rec.SubjectId)
+			}
+			switch {
+			case k == -1:
+				res.Status = "Error: the batch could not be replayed"
+			case fresh.GroupNames[groups[k]] == rec.AssignedGroup:
+				res.ReplayedGroup = fresh.GroupNames[groups[k]]
+				res.Status = "Match"
+			default:
+				res.ReplayedGroup = fresh.GroupNames[groups[k]]
+				res.Status = "Mismatch"
+			}
+		default:
+			M := make(map[string]string)
+			for j, va := range project.Variables {
+				M[va.Name] = data[j]
+			}
+			ii, err := selectGroup(&M, rec.Site, fresh, rec.Seed)
+			switch {
+			case err != nil:
+				res.Status = fmt.Sprintf("Error: %v", err)
+			case fresh.GroupNames[ii] == rec.AssignedGroup:
+				res.ReplayedGroup = fresh.GroupNames[ii]
+				res.Status = "Match"
+			default:
+				res.ReplayedGroup = fresh.GroupNames[ii]
+				res.Status = "Mismatch"
+			}
+		}
+
+		// Continue from the recorded assignment, so that
+		// each assignment is checked independently.
+		return getIndex(fresh.GroupNames, rec.AssignedGroup), nil
+	}
+
+	stage := func(ev *replayEvent) {
+		sa := ev.Stage
+		res := later[sa]
+		if sa.Seed == 0 {
+			res.Status = "Seed not recorded"
+			return
+		}
+		st := fresh.Stages[sa.Stage]
+		M := make(map[string]string)
+		for j, va := range st.Variables {
+			M[va.Name] = sa.Data[j]
+		}
+		ii, err := selectGroup(&M, "", stageProject(fresh, st), sa.Seed)
+		switch {
+		case err != nil:
+			res.Status = fmt.Sprintf("Error: %v", err)
+		case st.GroupNames[ii] == sa.Group:
+			res.ReplayedGroup = st.GroupNames[ii]
+			res.Status = "Match"
+		default:
+			res.ReplayedGroup = st.GroupNames[ii]
+			res.Status = "Mismatch"
+		}
+	}
+
+	_ = applyEvents(project, fresh, events, assign, stage)
+
+	return results, warnings
+}
+
+// assignedValues returns the values of the variables for a subject at
+// the time of the assignment.  The values that were filled in later
+// were missing at that time.
+func assignedValues(project *Project, rec *DataRecord) []string {
+
+	data := make([]string, len(rec.Data))
+	copy(data, rec.Data)
+	for _, f := range rec.Fills {
+		for j, va := range project.Variables {
+			if va.Name == f.Variable {
+				data[j] = ""
+			}
+		}
+	}
+
+	return data
+}
+
+// replayBatch replays the joint assignment of batch b (the position
+// plus one within project.Batches), using the aggregate data of the
+// copy fresh and the given seed.  The replayed group of each subject
+// of the batch is returned, or nil if the batch could not be replayed.
+func replayBatch(project, fresh *Project, b int, seed int64) []int {
+
+	if b > len(project.Batches) {
+		return nil
+	}
+	ba := project.Batches[b-1]
+
+	values := make([][]string, len(ba.SubjectIds))
+	for k, id := range ba.SubjectIds {
+		for _, rec := range project.RawData {
+			if rec.SubjectId == id {
+				values[k] = assignedValues(project, rec)
+			}
+		}
+		if values[k] == nil {
+			return nil
+		}
+	}
+
+	groups, _, _, err := selectBatch(fresh, values, ba.Site, ba.Mode, ba.Fraction, seed)
+	if err != nil {
+		return nil
+	}
+
+	return groups
+}
+
+// replayAssignmentsPage replays all the treatment assignments of a
+// project, and displays whether each replayed assignment matches the
+// recorded assignment.
+func replayAssignmentsPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "replayAssignmentsPage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if !project.StoreRawData {
+		msg := "The assignments can only be replayed for projects in which the complete data are stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	results, warnings := replayAssignments(project)
+
+	var numMatch, numMismatch, numOther int
+	for _, res := range results {
+		switch res.Status {
+		case "Match":
+			numMatch++
+		case "Mismatch":
+			numMismatch++
+		default:
+			numOther++
+		}
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		Results     []*ReplayResult
+		Warnings    []string
+		AnyStages   bool
+		NumMatch    int
+		NumMismatch int
+		NumOther    int
+		AllMatch    bool
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		Results:     results,
+		Warnings:    warnings,
+		AnyStages:   len(project.Stages) > 0,
+		NumMatch:    numMatch,
+		NumMismatch: numMismatch,
+		NumOther:    numOther,
+		AllMatch:    len(results) > 0 && numMatch == len(results) && len(warnings) == 0,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "replay_assignments.html", tvals); err != nil {
+		log.Errorf(ctx, "replayAssignmentsPage failed to execute template: %v", err)
+	}
+}
@@ -0,0 +1,585 @@
+package randomization
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// maxSimulatedAssignments is the largest total number of assignments
+// (trials times subjects per trial) in one simulation.
+const maxSimulatedAssignments = 500000
+
+// SimulationSettings contains the settings of a simulation of the
+// project's design.
+type SimulationSettings struct {
+	NumTrials   int
+	NumSubjects int
+	Seed        int64
+
+	// The distribution of each variable.  For a categorical
+	// variable, the relative frequencies of the levels, for a
+	// continuous variable, the mean and standard deviation of a
+	// normal distribution.
+	Dists [][]float64
+}
+
+// SimField is a form field of the simulation settings.
+type SimField struct {
+	Label string
+	Name  string
+	Value string
+}
+
+// SimVariable contains the form fields for the distribution of one
+// variable.
+type SimVariable struct {
+	Name       string
+	Continuous bool
+	Fields     []*SimField
+}
+
+// TrialResult contains the results of one simulated trial.
+type TrialResult struct {
+	// The final numbers of subjects in the groups.
+	Sizes []int
+
+	// The range of the group sizes, after dividing by the sampling
+	// rates.
+	SizeRange float64
+
+	// The imbalance of each variable under its scoring function,
+	// see variableImbalance, and their weighted sum.  The imbalance
+	// of a variable scored with "IsMin" is not defined, and is not
+	// included in the sum.
+	Imbalance    float64
+	VarImbalance []float64
+
+	// The proportion of the assignments that were correctly guessed
+	// by an observer who always guesses the group with the fewest
+	// subjects relative to its sampling rate.
+	Correct float64
+}
+
+// simField returns the name of the form field for parameter k of the
+// distribution of variable j.
+func simField(j, k int) string {
+	return fmt.Sprintf("dist%d_%d", j, k)
+}
+
+// simulationVariables returns the form fields for the distributions of
+// the project variables, with the values from the request, or the
+// default values if the request does not contain them.  By default
+// the levels of a categorical variable are equally frequent, and a
+// continuous variable is standard normal.
+func simulationVariables(project *Project, r *http.Request) []*SimVariable {
+
+	var vars []*SimVariable
+	for j, va := range project.Variables {
+		sv := &SimVariable{Name: va.Name, Continuous: va.Type == "Continuous"}
+		var labels, defaults []string
+		if sv.Continuous {
+			labels = []string{"Mean", "Standard deviation"}
+			defaults = []string{"0", "1"}
+		} else {
+			labels = va.Levels
+			for range va.Levels {
+				defaults = append(defaults, "1")
+			}
+		}
+		for k, label := range labels {
+			f := &SimField{Label: label, Name: simField(j, k), Value: defaults[k]}
+			if x := r.FormValue(f.Name); x != "" {
+				f.Value = x
+			}
+			sv.Fields = append(sv.Fields, f)
+		}
+		vars = append(vars, sv)
+	}
+
+	return vars
+}
+
+// parseSimulationSettings reads the simulation settings from the form
+// values of the request.  A new seed is generated if none is given.
+func parseSimulationSettings(project *Project, r *http.Request) (*SimulationSettings, error) {
+
+	if project.Method == "Cluster" {
+		return nil, fmt.Errorf("simulation is not available for cluster randomization")
+	}
+
+	settings := new(SimulationSettings)
+	var err error
+
+	settings.NumTrials, err = strconv.Atoi(strings.TrimSpace(r.FormValue("trials")))
+	if err != nil || settings.NumTrials < 1 {
+		return nil, fmt.Errorf("the number of trials must be a positive whole number")
+	}
+	settings.NumSubjects, err = strconv.Atoi(strings.TrimSpace(r.FormValue("subjects")))
+	if err != nil || settings.NumSubjects < 1 {
+		return nil, fmt.Errorf("the number of subjects must be a positive whole number")
+	}
+	if settings.NumTrials > maxSimulatedAssignments/settings.NumSubjects {
+		return nil, fmt.Errorf("the number of trials times the number of subjects may not exceed %d", maxSimulatedAssignments)
+	}
+
+	if s := strings.TrimSpace(r.FormValue("seed")); s != "" {
+		settings.Seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("the seed must be a whole number")
+		}
+	} else {
+		settings.Seed, err = newSeed()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sv := range simulationVariables(project, r) {
+		dist := make([]float64, len(sv.Fields))
+		total := 0.0
+		for k, f := range sv.Fields {
+			x, err := strconv.ParseFloat(strings.TrimSpace(f.Value), 64)
+			if err != nil || x < 0 {
+				return nil, fmt.Errorf("the value '%s' for '%s' of variable '%s' is not a non-negative number", f.Value, f.Label, sv.Name)
+			}
+			dist[k] = x
+			total += x
+		}
+		if !sv.Continuous && total == 0 {
+			return nil, fmt.Errorf("the frequencies of the levels of variable '%s' may not all be zero", sv.Name)
+		}
+		settings.Dists = append(settings.Dists, dist)
+	}
+
+	return settings, nil
+}
+
+// drawSubject returns the values of the variables for a random
+// subject, drawn from the distributions in the settings.
+func drawSubject(project *Project, settings *SimulationSettings, rgen *rand.Rand) map[string]string {
+
+	M := make(map[string]string)
+	for j, va := range project.Variables {
+		dist := settings.Dists[j]
+		if va.Type == "Continuous" {
+			x := dist[0] + dist[1]*rgen.NormFloat64()
+			M[va.Name] = strconv.FormatFloat(x, 'g', -1, 64)
+			continue
+		}
+		total := 0.0
+		for _, p := range dist {
+			total += p
+		}
+		u := total * rgen.Float64()
+		k := 0
+		for k < len(dist)-1 && u >= dist[k] {
+			u -= dist[k]
+			k++
+		}
+		M[va.Name] = va.Levels[k]
+	}
+
+	return M
+}
+
+// guessGroup returns the group that an observer who knows the previous
+// assignments would guess for the next subject at the given site,
+// using the convergence strategy of sizeGuesses with ties broken at
+// random.
+func guessGroup(project *Project, site string, rgen *rand.Rand) int {
+
+	ties := sizeGuesses(project, site)
+	return ties[rgen.Intn(len(ties))]
+}
+
+// simulateTrial simulates one trial, in which the given number of
+// subjects are assigned using the project's settings and allocation
+// method, starting with no assignments.  The subjects are drawn from
+// the distributions in the settings, and from the sites with equal
+// probability.  The allocator is called directly with rgen, without
+// calculating the probabilities of the groups.
+func simulateTrial(project *Project, settings *SimulationSettings, rgen *rand.Rand) (*TrialResult, error) {
+
+	alloc, err := getAllocator(project.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := initialProject(project)
+	fresh.StoreRawData = false
+
+	correct := 0
+	for n := 0; n < settings.NumSubjects; n++ {
+		M := drawSubject(project, settings, rgen)
+		site := ""
+		if len(project.Sites) > 0 {
+			site = project.Sites[rgen.Intn(len(project.Sites))]
+		}
+
+		guess := guessGroup(fresh, site, rgen)
+		ii, err := alloc.Assign(&M, site, fresh, rgen)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := recordAssignment(&M, site, fresh, ii, "", "", 0); err != nil {
+			return nil, err
+		}
+		if ii == guess {
+			correct++
+		}
+	}
+
+	res := &TrialResult{
+		Sizes:   fresh.Assignments,
+		Correct: float64(correct) / float64(settings.NumSubjects),
+	}
+	adj := make([]float64, len(fresh.Assignments))
+	for i, n := range fresh.Assignments {
+		adj[i] = float64(n) / project.SamplingRates[i]
+	}
+	res.SizeRange = Range(adj)
+	for j, va := range fresh.Variables {
+		imb := variableImbalance(&va, fresh.Data[j], project.SamplingRates)
+		res.VarImbalance = append(res.VarImbalance, imb)
+		if !math.IsNaN(imb) {
+			res.Imbalance += va.Weight * imb
+		}
+	}
+
+	return res, nil
+}
+
+// simulateTrials simulates the trials of a simulation, using a random
+// number generator with the seed of the settings, so that the results
+// can be reproduced.
+func simulateTrials(project *Project, settings *SimulationSettings) ([]*TrialResult, error) {
+
+	rgen := rand.New(rand.NewSource(settings.Seed))
+
+	results := make([]*TrialResult, settings.NumTrials)
+	for t := range results {
+		res, err := simulateTrial(project, settings, rgen)
+		if err != nil {
+			return nil, err
+		}
+		results[t] = res
+	}
+
+	return results, nil
+}
+
+// quantile returns the p-th quantile of the sorted values in x, using
+// the nearest rank.
+func quantile(x []float64, p float64) float64 {
+
+	k := int(math.Ceil(p*float64(len(x)))) - 1
+	if k < 0 {
+		k = 0
+	}
+	return x[k]
+}
+
+// summaryRow returns the label, followed by the mean, minimum, 5th
+// percentile, median, 95th percentile and maximum of the values in x.
+// NaN values are ignored, and "-" is shown if all values are NaN.
+func summaryRow(label string, x []float64, format string) []string {
+
+	var sorted []float64
+	for _, v := range x {
+		if !math.IsNaN(v) {
+			sorted = append(sorted, v)
+		}
+	}
+	if len(sorted) == 0 {
+		return []string{label, "-", "-", "-", "-", "-", "-"}
+	}
+	sort.Float64s(sorted)
+
+	mean := 0.0
+	for _, v := range sorted {
+		mean += v
+	}
+	mean /= float64(len(sorted))
+
+	return []string{
+		label,
+		fmt.Sprintf(format, mean),
+		fmt.Sprintf(format, sorted[0]),
+		fmt.Sprintf(format, quantile(sorted, 0.05)),
+		fmt.Sprintf(format, quantile(sorted, 0.5)),
+		fmt.Sprintf(format, quantile(sorted, 0.95)),
+		fmt.Sprintf(format, sorted[len(sorted)-1]),
+	}
+}
+
+// summarizeTrials returns the distributions of the imbalance and
+// predictability over the simulated trials, and the distribution of
+// the size of each group, in the form of summaryRow.
+func summarizeTrials(project *Project, results []*TrialResult) ([][]string, [][]string) {
+
+	n := len(results)
+	sizeRange := make([]float64, n)
+	imbalance := make([]float64, n)
+	correct := make([]float64, n)
+	for t, res := range results {
+		sizeRange[t] = res.SizeRange
+		imbalance[t] = res.Imbalance
+		correct[t] = res.Correct
+	}
+
+	stats := [][]string{summaryRow("Range of group sizes (relative to sampling rates)", sizeRange, "%.2f")}
+	if len(project.Variables) > 0 {
+		stats = append(stats, summaryRow("Weighted imbalance of all variables", imbalance, "%.3f"))
+	}
+	for j, va := range project.Variables {
+		x := make([]float64, n)
+		for t, res := range results {
+			x[t] = res.VarImbalance[j]
+		}
+		stats = append(stats, summaryRow("Imbalance of "+va.Name, x, "%.3f"))
+	}
+	stats = append(stats, summaryRow("Proportion of correctly guessed assignments", correct, "%.3f"))
+
+	var sizes [][]string
+	for i, g := range project.GroupNames {
+		x := make([]float64, n)
+		for t, res := range results {
+			x[t] = float64(res.Sizes[i])
+		}
+		sizes = append(sizes, summaryRow(g, x, "%.1f"))
+	}
+
+	return stats, sizes
+}
+
+// writeSimulation writes the results of each simulated trial in CSV
+// format.
+func writeSimulation(w io.Writer, project *Project, results []*TrialResult) error {
+
+	cw := csv.NewWriter(w)
+
+	header := []string{"Trial"}
+	for _, g := range project.GroupNames {
+		header = append(header, g+" size")
+	}
+	header = append(header, "Size range", "Imbalance")
+	for _, va := range project.Variables {
+		header = append(header, va.Name+" imbalance")
+	}
+	header = append(header, "Correct guesses")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for t, res := range results {
+		row := []string{strconv.Itoa(t + 1)}
+		for _, n := range res.Sizes {
+			row = append(row, strconv.Itoa(n))
+		}
+		row = append(row, fmt.Sprintf("%g", res.SizeRange), fmt.Sprintf("%g", res.Imbalance))
+		for _, x := range res.VarImbalance {
+			row = append(row, fmt.Sprintf("%g", x))
+		}
+		row = append(row, fmt.Sprintf("%g", res.Correct))
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// simulatePage displays a form to enter the settings of a simulation
+// of the project's design.
+func simulatePage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "simulatePage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if project.Method == "Cluster" {
+		msg := "Simulation is not available for cluster randomization."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	tvals := struct {
+		User           string
+		LoggedIn       bool
+		ProjectName    string
+		Pkey           string
+		Variables      []*SimVariable
+		MaxAssignments int
+	}{
+		User:           user.String(),
+		LoggedIn:       user != nil,
+		ProjectName:    project.Name,
+		Pkey:           pkey,
+		Variables:      simulationVariables(project, r),
+		MaxAssignments: maxSimulatedAssignments,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "simulate.html", tvals); err != nil {
+		log.Errorf(ctx, "simulatePage failed to execute template: %v", err)
+	}
+}
+
+// runSimulation loads the project and runs the simulation with the
+// settings in the request.  If an error occurs, a message is displayed
+// and nil is returned.
+func runSimulation(w http.ResponseWriter, r *http.Request, pkey string) (*Project, *SimulationSettings, []*TrialResult) {
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "runSimulation: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return nil, nil, nil
+	}
+
+	settings, err := parseSimulationSettings(project, r)
+	if err != nil {
+		msg := fmt.Sprintf("The simulation was not run: %v.", err)
+		rmsg := "Return to simulation"
+		messagePage(w, r, user, msg, rmsg, "/simulate?pkey="+pkey)
+		return nil, nil, nil
+	}
+
+	results, err := simulateTrials(project, settings)
+	if err != nil {
+		msg := fmt.Sprintf("The simulation failed: %v.", err)
+		rmsg := "Return to simulation"
+		messagePage(w, r, user, msg, rmsg, "/simulate?pkey="+pkey)
+		return nil, nil, nil
+	}
+
+	return project, settings, results
+}
+
+// simulationReport runs a simulation of the project's design, and
+// displays the distributions of the imbalance, group sizes and
+// predictability over the simulated trials.
+func simulationReport(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, settings, results := runSimulation(w, r, pkey)
+	if results == nil {
+		return
+	}
+
+	stats, sizes := summarizeTrials(project, results)
+
+	// The settings are passed on to the CSV download, which
+	// repeats the simulation with the same seed.
+	fields := []*SimField{
+		{Name: "trials", Value: strconv.Itoa(settings.NumTrials)},
+		{Name: "subjects", Value: strconv.Itoa(settings.NumSubjects)},
+		{Name: "seed", Value: strconv.FormatInt(settings.Seed, 10)},
+	}
+	for _, sv := range simulationVariables(project, r) {
+		fields = append(fields, sv.Fields...)
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		Method      string
+		Settings    *SimulationSettings
+		Stats       [][]string
+		Sizes       [][]string
+		Fields      []*SimField
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		Method:      project.Method,
+		Settings:    settings,
+		Stats:       stats,
+		Sizes:       sizes,
+		Fields:      fields,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "simulation_report.html", tvals); err != nil {
+		log.Errorf(ctx, "simulationReport failed to execute template: %v", err)
+	}
+}
+
+// simulationCSV runs a simulation of the project's design, and writes
+// the results of each simulated trial in CSV format.
+func simulationCSV(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, _, results := runSimulation(w, r, pkey)
+	if results == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename=simulation.csv")
+
+	if err := writeSimulation(w, project, results); err != nil {
+		log.Errorf(ctx, "simulationCSV: %v", err)
+	}
+}
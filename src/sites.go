@@ -0,0 +1,209 @@
+package randomization
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// parseSites converts a comma separated list of site names to a
+// slice.  A blank list means that the project has no sites.
+func parseSites(s string) ([]string, error) {
+
+	sites := cleanSplit(s, ",")
+	if len(sites) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	for _, x := range sites {
+		if x == "" {
+			return nil, fmt.Errorf("site names may not be blank.")
+		}
+		if seen[x] {
+			return nil, fmt.Errorf("the site '%s' is listed more than once.", x)
+		}
+		seen[x] = true
+	}
+
+	return sites, nil
+}
+
+// siteAggregates returns the aggregate data and group sizes within the
+// given site.  If no subjects have been assigned at the site, zero
+// aggregates are returned, but they are not added to the project.
+func siteAggregates(project *Project, site string) ([][][]float64, []int) {
+
+	data := project.SiteData[site]
+	assignments := project.SiteAssignments[site]
+	if data == nil {
+		data = newAggregateData(project)
+	}
+	if assignments == nil {
+		assignments = make([]int, len(project.GroupNames))
+	}
+
+	return data, assignments
+}
+
+// updateSiteAggregates updates the aggregate data within a site when a
+// subject with the given values of the project variables is added to
+// (d=1) or removed from (d=-1) group grp.
+func updateSiteAggregates(project *Project, site string, values []string, grp int, d int) error {
+
+	if site == "" || project.SiteData == nil {
+		return nil
+	}
+
+	data, assignments := siteAggregates(project, site)
+	project.SiteData[site] = data
+	project.SiteAssignments[site] = assignments
+
+	assignments[grp] += d
+	for j, va := range project.Variables {
+		if err := updateVariableData(&va, data[j], values[j], grp, float64(d)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// editSites displays a form for the project owner to set the default
+// site of each user who has access to the project.
+func editSites(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "editSites: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage the sites."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if len(project.Sites) == 0 {
+		msg := "This project does not have any sites."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	sharedUsers, err := getSharedUsers(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "editSites: %v", err)
+	}
+	users := append([]string{strings.ToLower(project.Owner)}, sharedUsers...)
+
+	// Each row contains a user name and their current site.
+	var userSites [][]string
+	for _, u := range users {
+		userSites = append(userSites, []string{u, project.UserSites[u]})
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		Sites       []string
+		UserSites   [][]string
+		Users       string
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		Sites:       project.Sites,
+		UserSites:   userSites,
+		Users:       strings.Join(users, ","),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "edit_sites.html", tvals); err != nil {
+		log.Errorf(ctx, "editSites failed to execute template: %v", err)
+	}
+}
+
+// editSitesConfirm stores the default sites of the users.
+func editSitesConfirm(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "editSitesConfirm: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage the sites."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	userSites := make(map[string]string)
+	for i, u := range cleanSplit(r.FormValue("users"), ",") {
+		site := r.FormValue("site" + strconv.Itoa(i))
+		if site == "" {
+			continue
+		}
+		if getIndex(project.Sites, site) == -1 {
+			msg := fmt.Sprintf("'%s' is not a site of this project.", site)
+			rmsg := "Return to project"
+			messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+		userSites[u] = site
+	}
+	project.UserSites = userSites
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "editSitesConfirm: %v", err)
+		msg := "A datastore error occured, the sites could not be updated."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	msg := "The default sites of the users have been updated."
+	rmsg := "Return to project"
+	messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
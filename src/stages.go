@@ -0,0 +1,637 @@
+package randomization
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/user"
+)
+
+// stageName returns the name of stage s, where s is a position within
+// project.Stages, or -1 for the first stage.
+func stageName(project *Project, s int) string {
+
+	if s == -1 {
+		return "Stage 1"
+	}
+	return project.Stages[s].Name
+}
+
+// previousGroups returns the treatment groups of the stage before
+// stage s, where s is a position within project.Stages.
+func previousGroups(project *Project, s int) []string {
+
+	if s == 0 {
+		return project.GroupNames
+	}
+	return project.Stages[s-1].GroupNames
+}
+
+// stageProject returns a project whose treatment groups, variables
+// and aggregate data are those of the given stage, so that the
+// subjects can be assigned within the stage by minimization.  The
+// returned project shares the aggregate data of the stage.
+func stageProject(project *Project, st *Stage) *Project {
+
+	rates := make([]float64, len(st.GroupNames))
+	for i := range rates {
+		rates[i] = 1
+	}
+
+	return &Project{
+		Name:          project.Name,
+		GroupNames:    st.GroupNames,
+		Variables:     st.Variables,
+		Assignments:   st.Assignments,
+		Data:          st.Data,
+		Bias:          st.Bias,
+		Method:        "Minimization",
+		SamplingRates: rates,
+	}
+}
+
+// parseStageGroups converts a comma separated list of the treatment
+// groups of a stage to a slice.
+func parseStageGroups(s string) ([]string, error) {
+
+	groups := cleanSplit(s, ",")
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("the stage must have at least two treatment groups.")
+	}
+
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		if g == "" {
+			return nil, fmt.Errorf("group names may not be blank.")
+		}
+		if seen[g] {
+			return nil, fmt.Errorf("the group '%s' is listed more than once.", g)
+		}
+		seen[g] = true
+	}
+
+	return groups, nil
+}
+
+// parseEligibility converts an eligibility condition of the form
+// "name = level1, level2" to the variable name and its eligible
+// levels.  A blank condition means that all subjects are eligible.
+func parseEligibility(s string, variables []Variable) (string, []string, error) {
+
+	if strings.TrimSpace(s) == "" {
+		return "", nil, nil
+	}
+
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("the eligibility condition does not have the form 'name = level1, level2, ...'.")
+	}
+	name := strings.TrimSpace(parts[0])
+	levels := cleanSplit(parts[1], ",")
+
+	for _, va := range variables {
+		if va.Name != name {
+			continue
+		}
+		for _, x := range levels {
+			if getIndex(va.Levels, x) == -1 {
+				return "", nil, fmt.Errorf("'%s' is not a level of variable '%s'.", x, name)
+			}
+		}
+		return name, levels, nil
+	}
+
+	return "", nil, fmt.Errorf("the eligibility condition uses the unknown variable '%s'.", name)
+}
+
+// newStage returns a new stage that follows the current last stage of
+// the project.  The group in the previous stage is added as the first
+// variable of the stage, so that the assignments are balanced within
+// each previous group.
+func newStage(project *Project, groups []string, variables []Variable, eligible []string, cvar string, clevels []string, bias int) *Stage {
+
+	s := len(project.Stages)
+	prev := Variable{
+		Name:   stageName(project, s-1) + " group",
+		Levels: eligible,
+		Weight: 1,
+		Func:   "Range",
+		Type:   "Categorical",
+	}
+
+	st := &Stage{
+		Name:             fmt.Sprintf("Stage %d", s+2),
+		GroupNames:       groups,
+		Variables:        append([]Variable{prev}, variables...),
+		EligibleGroups:   eligible,
+		EligibleVariable: cvar,
+		EligibleLevels:   clevels,
+		Bias:             bias,
+		Assignments:      make([]int, len(groups)),
+	}
+	st.Data = newAggregateData(stageProject(project, st))
+
+	return st
+}
+
+// nextStage returns the position within project.Stages of the next
+// stage of a subject, and the subject's group in the previous stage.
+// The position is len(project.Stages) if the subject has been
+// assigned in all stages.
+func nextStage(project *Project, rec *DataRecord) (int, string) {
+
+	s := len(rec.StageAssignments)
+	if s == 0 {
+		return 0, rec.CurrentGroup
+	}
+	return s, rec.StageAssignments[s-1].Group
+}
+
+// stageEligible returns an error if a subject whose group in the
+// previous stage is prev, and whose values of the stage variables are
+// in M, is not eligible for the stage.
+func stageEligible(st *Stage, prev string, M map[string]string) error {
+
+	if getIndex(st.EligibleGroups, prev) == -1 {
+		return fmt.Errorf("subjects in group '%s' are not eligible for %s", prev, st.Name)
+	}
+
+	if st.EligibleVariable != "" && getIndex(st.EligibleLevels, M[st.EligibleVariable]) == -1 {
+		return fmt.Errorf("subjects with %s = '%s' are not eligible for %s", st.EligibleVariable, M[st.EligibleVariable], st.Name)
+	}
+
+	return nil
+}
+
+// assignStage assigns a subject to a treatment group in the subject's
+// next stage, using the values of the stage variables in M (not
+// including the previous group), and records the assignment.
+func assignStage(project *Project, rec *DataRecord, M map[string]string, userId string) (string, error) {
+
+	if !rec.Included {
+		return "", fmt.Errorf("subject '%s' has been removed from the project", rec.SubjectId)
+	}
+
+	s, prev := nextStage(project, rec)
+	if s >= len(project.Stages) {
+		return "", fmt.Errorf("subject '%s' has been assigned in all stages", rec.SubjectId)
+	}
+	st := project.Stages[s]
+
+	if err := stageEligible(st, prev, M); err != nil {
+		return "", err
+	}
+
+	M[st.Variables[0].Name] = prev
+	values := make([]string, len(st.Variables))
+	for j, va := range st.Variables {
+		values[j] = M[va.Name]
+	}
+
+	seed, err := newSeed()
+	if err != nil {
+		return "", err
+	}
+
+	sp := stageProject(project, st)
+	ii, probs, err := selectGroupProbs(&M, "", sp, seed)
+	if err != nil {
+		return "", err
+	}
+
+	sa := &StageAssignment{
+		Stage:    s,
+		Time:     time.Now(),
+		Group:    st.GroupNames[ii],
+		Data:     values,
+		Seed:     seed,
+		Assigner: userId,
+		Probs:    probs,
+	}
+	if err := updateStage(project, sa, 1); err != nil {
+		return "", err
+	}
+	rec.StageAssignments = append(rec.StageAssignments, sa)
+
+	return sa.Group, nil
+}
+
+// updateStage updates the aggregate data of a stage when a stage
+// assignment is added (d=1) or removed (d=-1).
+func updateStage(project *Project, sa *StageAssignment, d int) error {
+
+	st := project.Stages[sa.Stage]
+	grp := getIndex(st.GroupNames, sa.Group)
+	st.Assignments[grp] += d
+	for j, va := range st.Variables {
+		if err := updateVariableData(&va, st.Data[j], sa.Data[j], grp, float64(d)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// updateStageAggregates updates the aggregate data of the later stages
+// when a subject is added to (d=1) or removed from (d=-1) the project.
+func updateStageAggregates(project *Project, rec *DataRecord, d int) {
+
+	for _, sa := range rec.StageAssignments {
+		_ = updateStage(project, sa, d)
+	}
+}
+
+// StageStat contains the numbers of subjects assigned to each group of
+// a stage, overall and within the levels of the stage variables.
+type StageStat struct {
+	Name       string
+	GroupNames []string
+	Stat       [][]string
+}
+
+// stageStats returns the statistics of each later stage of the
+// project.
+func stageStats(project *Project) []*StageStat {
+
+	var stats []*StageStat
+	for _, st := range project.Stages {
+		row := make([]string, 1+len(st.GroupNames))
+		row[0] = "All subjects"
+		for q, n := range st.Assignments {
+			row[q+1] = fmt.Sprintf("%d", n)
+		}
+		stat := append([][]string{row}, levelStats(stageProject(project, st), st.Data, st.Assignments, "")...)
+		stats = append(stats, &StageStat{Name: st.Name, GroupNames: st.GroupNames, Stat: stat})
+	}
+
+	return stats
+}
+
+// formatStage returns a description of a stage.
+func formatStage(project *Project, s int) string {
+
+	st := project.Stages[s]
+	desc := fmt.Sprintf("%s: %s, for subjects in %s", st.Name, strings.Join(st.GroupNames, ","),
+		strings.Join(st.EligibleGroups, ","))
+	if st.EligibleVariable != "" {
+		desc += fmt.Sprintf(" with %s = %s", st.EligibleVariable, strings.Join(st.EligibleLevels, ","))
+	}
+
+	return desc
+}
+
+// stagesPage displays the stages of a project, with a form to add a
+// stage.
+func stagesPage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "stagesPage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage its stages."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !project.StoreRawData {
+		msg := "Stages can only be used in projects in which the complete data are stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	var stages []string
+	for s := range project.Stages {
+		stages = append(stages, formatStage(project, s))
+	}
+
+	tvals := struct {
+		User           string
+		LoggedIn       bool
+		ProjectName    string
+		Pkey           string
+		Stages         []string
+		NextStage      string
+		PreviousStage  string
+		PreviousGroups []string
+	}{
+		User:           user.String(),
+		LoggedIn:       user != nil,
+		ProjectName:    project.Name,
+		Pkey:           pkey,
+		Stages:         stages,
+		NextStage:      fmt.Sprintf("Stage %d", len(project.Stages)+2),
+		PreviousStage:  stageName(project, len(project.Stages)-1),
+		PreviousGroups: previousGroups(project, len(project.Stages)),
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "stages.html", tvals); err != nil {
+		log.Errorf(ctx, "stagesPage failed to execute template: %v", err)
+	}
+}
+
+// addStage adds a stage to a project.
+func addStage(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	pkey := r.FormValue("pkey")
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "addStage: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if project.Owner != user.String() {
+		msg := "Only the owner of a project can manage its stages."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	if !project.StoreRawData {
+		msg := "Stages can only be used in projects in which the complete data are stored."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	groups, err := parseStageGroups(r.FormValue("group_names"))
+	if err != nil {
+		msg := fmt.Sprintf("The stage was not added: %v", err)
+		rmsg := "Return to stages"
+		messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+		return
+	}
+
+	var eligible []string
+	for _, g := range previousGroups(project, len(project.Stages)) {
+		if r.FormValue("eligible_"+g) == "yes" {
+			eligible = append(eligible, g)
+		}
+	}
+	if len(eligible) == 0 {
+		msg := "The stage was not added: at least one group of the previous stage must be eligible."
+		rmsg := "Return to stages"
+		messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+		return
+	}
+
+	var variables []Variable
+	entries, err := parseNamedLevels(r.FormValue("variables"))
+	if err != nil {
+		msg := fmt.Sprintf("The stage was not added: %v", err)
+		rmsg := "Return to stages"
+		messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+		return
+	}
+	prevName := stageName(project, len(project.Stages)-1) + " group"
+	for _, e := range entries {
+		if e.Name == prevName {
+			msg := fmt.Sprintf("The stage was not added: the variable name '%s' is used for the group in the previous stage.", prevName)
+			rmsg := "Return to stages"
+			messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+			return
+		}
+		variables = append(variables, Variable{Name: e.Name, Levels: e.Levels, Weight: 1, Func: "Range", Type: "Categorical"})
+	}
+
+	cvar, clevels, err := parseEligibility(r.FormValue("condition"), variables)
+	if err != nil {
+		msg := fmt.Sprintf("The stage was not added: %v", err)
+		rmsg := "Return to stages"
+		messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+		return
+	}
+
+	bias, err := strconv.Atoi(r.FormValue("bias"))
+	if err != nil || bias < 1 || bias > 10 {
+		msg := "The stage was not added: the determinism must be a whole number between 1 and 10."
+		rmsg := "Return to stages"
+		messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+		return
+	}
+
+	st := newStage(project, groups, variables, eligible, cvar, clevels, bias)
+	project.Stages = append(project.Stages, st)
+
+	comment := new(Comment)
+	comment.Person = user.String()
+	comment.DateTime = time.Now()
+	comment.Comment = []string{fmt.Sprintf("Added %s.", formatStage(project, len(project.Stages)-1))}
+	project.Comments = append(project.Comments, comment)
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "addStage: %v", err)
+		msg := "A datastore error occured, the stage was not added."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("%s has been added to the project.", st.Name)
+	rmsg := "Return to stages"
+	messagePage(w, r, user, msg, rmsg, "/stages?pkey="+pkey)
+}
+
+// rerandomizeInput displays a form to select a subject for assignment
+// in the subject's next stage, and then a form to enter the values of
+// the stage variables.
+func rerandomizeInput(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "GET" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "rerandomizeInput: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	// The subjects who may be eligible for their next stage.
+	var subjects []string
+	for _, rec := range project.RawData {
+		s, prev := nextStage(project, rec)
+		if rec.Included && s < len(project.Stages) && getIndex(project.Stages[s].EligibleGroups, prev) != -1 {
+			subjects = append(subjects, rec.SubjectId)
+		}
+	}
+
+	var stage *Stage
+	subjectId := r.FormValue("subject_id")
+	if subjectId != "" {
+		for _, rec := range project.RawData {
+			if rec.SubjectId == subjectId {
+				if s, _ := nextStage(project, rec); s < len(project.Stages) {
+					stage = project.Stages[s]
+				}
+			}
+		}
+		if stage == nil || getIndex(subjects, subjectId) == -1 {
+			msg := fmt.Sprintf("Subject '%s' is not eligible for a further stage.", subjectId)
+			rmsg := "Return to project"
+			messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+			return
+		}
+	}
+
+	var variables []Variable
+	if stage != nil {
+		variables = stage.Variables[1:]
+	}
+
+	tvals := struct {
+		User        string
+		LoggedIn    bool
+		ProjectName string
+		Pkey        string
+		Subjects    []string
+		SubjectId   string
+		Stage       *Stage
+		Variables   []Variable
+	}{
+		User:        user.String(),
+		LoggedIn:    user != nil,
+		ProjectName: project.Name,
+		Pkey:        pkey,
+		Subjects:    subjects,
+		SubjectId:   subjectId,
+		Stage:       stage,
+		Variables:   variables,
+	}
+
+	if err := tmpl.ExecuteTemplate(w, "rerandomize.html", tvals); err != nil {
+		log.Errorf(ctx, "rerandomizeInput failed to execute template: %v", err)
+	}
+}
+
+// rerandomize assigns a subject to a treatment group in the subject's
+// next stage.
+func rerandomize(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		Serve404(w)
+		return
+	}
+
+	ctx := appengine.NewContext(r)
+	user := user.Current(ctx)
+	pkey := r.FormValue("pkey")
+
+	if ok := checkAccess(ctx, user, pkey, &w, r); !ok {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		ServeError(ctx, w, err)
+		return
+	}
+
+	project, err := getProjectFromKey(ctx, pkey)
+	if err != nil {
+		log.Errorf(ctx, "rerandomize: %v", err)
+		msg := "A datastore error occured, the project could not be loaded."
+		rmsg := "Return to dashboard"
+		messagePage(w, r, user, msg, rmsg, "/dashboard")
+		return
+	}
+
+	if !project.Open {
+		msg := "This project is currently not open for new enrollments.  The project owner can change this by following the \"Open/close enrollment\" link on the project dashboard."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	subjectId := r.FormValue("subject_id")
+	var rec *DataRecord
+	for _, z := range project.RawData {
+		if z.SubjectId == subjectId {
+			rec = z
+		}
+	}
+	if rec == nil {
+		msg := fmt.Sprintf("There is no subject '%s' in the project.", subjectId)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	M := make(map[string]string)
+	if s, _ := nextStage(project, rec); s < len(project.Stages) {
+		for _, va := range project.Stages[s].Variables[1:] {
+			M[va.Name] = r.FormValue(va.Name)
+		}
+	}
+
+	group, err := assignStage(project, rec, M, user.String())
+	if err != nil {
+		msg := fmt.Sprintf("The subject was not assigned: %v.", err)
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+	stage := project.Stages[len(rec.StageAssignments)-1]
+	project.Modified = time.Now()
+
+	if err := storeProject(ctx, project, pkey); err != nil {
+		log.Errorf(ctx, "rerandomize: %v", err)
+		msg := "A datastore error occured, the subject was not assigned."
+		rmsg := "Return to project"
+		messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+		return
+	}
+
+	msg := fmt.Sprintf("Subject '%s' has been assigned to group '%s' in %s.", subjectId, group, stage.Name)
+	rmsg := "Return to project"
+	messagePage(w, r, user, msg, rmsg, "/project_dashboard?pkey="+pkey)
+}
@@ -0,0 +1,159 @@
+package randomization
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/log"
+)
+
+// maxProjectsPerUser is the largest number of projects owned by a user
+// that are listed on the dashboard.
+const maxProjectsPerUser = 100
+
+// ErrNoSuchProject is returned by a repository when the requested
+// project does not exist.
+var ErrNoSuchProject = errors.New("the project does not exist")
+
+// Repository stores the projects and the users with whom they are
+// shared.  A project is identified by its key, which is the owner and
+// the project name joined by "::".  User names are compared without
+// regard to case when looking up the projects shared with a user.
+type Repository interface {
+	// GetProject returns the project with the given key, or
+	// ErrNoSuchProject.
+	GetProject(ctx context.Context, pkey string) (*EncodedProject, error)
+
+	// PutProject stores a project under the given key, replacing
+	// any project with the same key.
+	PutProject(ctx context.Context, pkey string, eproj *EncodedProject) error
+
+	// DeleteProject removes the project with the given key.
+	DeleteProject(ctx context.Context, pkey string) error
+
+	// GetProjects returns the keys of at most limit projects
+	// owned by the given user, and the projects, with the most
+	// recently created first.
+	GetProjects(ctx context.Context, owner string, limit int) ([]string, []*EncodedProject, error)
+
+	// GetSharedUsers returns the users with whom the project is
+	// shared.
+	GetSharedUsers(ctx context.Context, pkey string) ([]string, error)
+
+	// GetSharedProjects returns the keys of the projects that are
+	// shared with the given user.
+	GetSharedProjects(ctx context.Context, userName string) ([]string, error)
+
+	// AddSharing shares the project with the given users.
+	AddSharing(ctx context.Context, pkey string, userNames []string) error
+
+	// RemoveSharing stops sharing the project with the given
+	// users.
+	RemoveSharing(ctx context.Context, pkey string, userNames []string) error
+
+	// DeleteSharing stops sharing the project with all users.
+	DeleteSharing(ctx context.Context, pkey string) error
+}
+
+// repository is the storage used by all handlers.  It is the App
+// Engine datastore unless another repository is set with
+// SetRepository.
+var repository Repository = datastoreRepository{}
+
+// SetRepository replaces the storage used by all handlers, for example
+// with a SQL database, see NewSQLRepository.  It must be called before
+// any requests are served, for example from an init function of the
+// program that registers the handlers.  The handlers still use the
+// App Engine context and login services.
+func SetRepository(r Repository) {
+	repository = r
+}
+
+// projectExists returns true if a project with the given key has been
+// stored.
+func projectExists(ctx context.Context, pkey string) bool {
+
+	_, err := repository.GetProject(ctx, pkey)
+	return err == nil
+}
+
+// getSharedUsers returns a list of user id's for for users who are
+// shared for the given project.
+func getSharedUsers(ctx context.Context, projectName string) ([]string, error) {
+
+	users, err := repository.GetSharedUsers(ctx, projectName)
+	if err != nil {
+		log.Errorf(ctx, "getSharedUsers: %v", err)
+		return []string{}, err
+	}
+
+	return users, nil
+}
+
+// addSharing adds all the given users to be shared for the given
+// project.
+func addSharing(ctx context.Context, projectName string, userNames []string) error {
+
+	if len(userNames) == 0 {
+		return nil
+	}
+
+	if err := repository.AddSharing(ctx, projectName, userNames); err != nil {
+		log.Errorf(ctx, "addSharing: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+// removeSharing removes the given users from the access list for the given project.
+func removeSharing(ctx context.Context, projectName string, userNames []string) error {
+
+	return repository.RemoveSharing(ctx, projectName, userNames)
+}
+
+// getProjects returns all projects owned by the given user.
+// Optionally also include projects that are shared with the user.
+func getProjects(ctx context.Context, user string, includeShared bool) ([]string, []*EncodedProject, error) {
+
+	keylist, projlist, err := repository.GetProjects(ctx, user, maxProjectsPerUser)
+	if err != nil {
+		log.Errorf(ctx, "GetProjects[1]: %v", err)
+		return nil, nil, err
+	}
+
+	if !includeShared {
+		return keylist, projlist, err
+	}
+
+	keyset := make(map[string]bool)
+	for _, k := range keylist {
+		keyset[k] = true
+	}
+
+	// Get project ids that are shared with this user
+	spvl, err := repository.GetSharedProjects(ctx, strings.ToLower(user))
+	if err != nil {
+		log.Errorf(ctx, "getProjects[2]: %v", err)
+		return nil, nil, err
+	}
+
+	// Get the shared projects
+	for _, spv := range spvl {
+		if keyset[spv] {
+			continue
+		}
+		keyset[spv] = true
+		pr, err := repository.GetProject(ctx, spv)
+		if err != nil {
+			log.Infof(ctx, "getProjects [3]: %v\n%v", spv, err)
+			continue
+		}
+		keylist = append(keylist, spv)
+		projlist = append(projlist, pr)
+	}
+
+	return keylist, projlist, nil
+}
@@ -0,0 +1,253 @@
+package randomization
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// datastoreRepository stores the projects in the App Engine datastore,
+// using the EncodedProject, SharingByUser and SharingByProject kinds.
+// The sharing of each project is stored twice, by project and by user,
+// with the user names of SharingByUser converted to lower case.
+type datastoreRepository struct{}
+
+func (datastoreRepository) GetProject(ctx context.Context, pkey string) (*EncodedProject, error) {
+
+	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
+	eproj := new(EncodedProject)
+	err := datastore.Get(ctx, key, eproj)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, ErrNoSuchProject
+	} else if err != nil {
+		return nil, err
+	}
+
+	return eproj, nil
+}
+
+func (datastoreRepository) PutProject(ctx context.Context, pkey string, eproj *EncodedProject) error {
+
+	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
+	_, err := datastore.Put(ctx, key, eproj)
+
+	return err
+}
+
+func (datastoreRepository) DeleteProject(ctx context.Context, pkey string) error {
+
+	key := datastore.NewKey(ctx, "EncodedProject", pkey, 0, nil)
+
+	return datastore.Delete(ctx, key)
+}
+
+func (datastoreRepository) GetProjects(ctx context.Context, owner string, limit int) ([]string, []*EncodedProject, error) {
+
+	qr := datastore.NewQuery("EncodedProject").
+		Filter("Owner = ", owner).
+		Order("-Created").Limit(limit)
+
+	var projlist []*EncodedProject
+	keys, err := qr.GetAll(ctx, &projlist)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keylist := make([]string, len(keys))
+	for i, k := range keys {
+		keylist[i] = k.StringID()
+	}
+
+	return keylist, projlist, nil
+}
+
+func (datastoreRepository) GetSharedUsers(ctx context.Context, pkey string) ([]string, error) {
+
+	key := datastore.NewKey(ctx, "SharingByProject", pkey, 0, nil)
+
+	var sproj SharingByProject
+	err := datastore.Get(ctx, key, &sproj)
+	if err == datastore.ErrNoSuchEntity {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(sproj.Users) == 0 {
+		return []string{}, nil
+	}
+
+	return cleanSplit(sproj.Users, ","), nil
+}
+
+func (datastoreRepository) GetSharedProjects(ctx context.Context, userName string) ([]string, error) {
+
+	key := datastore.NewKey(ctx, "SharingByUser", strings.ToLower(userName), 0, nil)
+
+	var sbuser SharingByUser
+	err := datastore.Get(ctx, key, &sbuser)
+	if err == datastore.ErrNoSuchEntity {
+		// No projects shared with this user
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return cleanSplit(sbuser.Projects, ","), nil
+}
+
+func (datastoreRepository) AddSharing(ctx context.Context, projectName string, userNames []string) error {
+
+	// Update SharingByProject
+	key := datastore.NewKey(ctx, "SharingByProject", projectName, 0, nil)
+	sbproj := new(SharingByProject)
+	err := datastore.Get(ctx, key, sbproj)
+	if err == datastore.ErrNoSuchEntity {
+		// Create a new SharingByProject and carry on
+		sbproj.ProjectName = projectName
+		sbproj.Users = strings.Join(userNames, ",")
+	} else if err != nil {
+		return err
+	} else {
+		U := cleanSplit(sbproj.Users, ",")
+		sbproj.Users = strings.Join(uniqueSvec(append(U, userNames...)), ",")
+	}
+
+	_, err = datastore.Put(ctx, key, sbproj)
+	if err != nil {
+		return err
+	}
+
+	// Update SharingByUser
+	for _, uname := range userNames {
+
+		key = datastore.NewKey(ctx, "SharingByUser", strings.ToLower(uname), 0, nil)
+		sbuser := new(SharingByUser)
+
+		err := datastore.Get(ctx, key, sbuser)
+		if err == datastore.ErrNoSuchEntity {
+			sbuser = new(SharingByUser)
+			sbuser.User = uname
+			sbuser.Projects = projectName
+		} else if err != nil {
+			return err
+		} else {
+			U := cleanSplit(sbuser.Projects, ",")
+			sbuser.Projects = strings.Join(uniqueSvec(append(U, projectName)), ",")
+		}
+
+		_, err = datastore.Put(ctx, key, sbuser)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (datastoreRepository) RemoveSharing(ctx context.Context, projectName string, userNames []string) error {
+
+	// Map whose keys are the users to remove.
+	rmu := make(map[string]bool)
+	for i := 0; i < len(userNames); i++ {
+		rmu[userNames[i]] = true
+	}
+
+	// Update SharingByProject.
+	key := datastore.NewKey(ctx, "SharingByProject", projectName, 0, nil)
+	sproj := new(SharingByProject)
+	err := datastore.Get(ctx, key, sproj)
+	if err == datastore.ErrNoSuchEntity {
+		// OK
+	} else if err != nil {
+		return err
+	} else {
+		users := cleanSplit(sproj.Users, ",")
+		users = uniqueSvec(users)
+		users = sdiff(users, rmu)
+		sproj.Users = strings.Join(users, ",")
+		_, err = datastore.Put(ctx, key, sproj)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Update SharingByUser
+	for _, name := range userNames {
+		pkey := datastore.NewKey(ctx, "SharingByUser", strings.ToLower(name), 0, nil)
+		suser := new(SharingByUser)
+		err := datastore.Get(ctx, pkey, suser)
+		if err == datastore.ErrNoSuchEntity {
+			// should not reach here
+		} else if err != nil {
+			return err
+		} else {
+			projlist := cleanSplit(suser.Projects, ",")
+			projlist = uniqueSvec(projlist)
+			projlist = sdiff(projlist, map[string]bool{projectName: true})
+			suser.Projects = strings.Join(projlist, ",")
+
+			_, err = datastore.Put(ctx, pkey, suser)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r datastoreRepository) DeleteSharing(ctx context.Context, pkey string) error {
+
+	// Read the users from the SharingByProject object, so that the
+	// project can be removed from their SharingByUser records.
+	users, err := r.GetSharedUsers(ctx, pkey)
+	if err != nil {
+		return err
+	}
+	if err := r.RemoveSharing(ctx, pkey, users); err != nil {
+		return err
+	}
+
+	key := datastore.NewKey(ctx, "SharingByProject", pkey, 0, nil)
+	err = datastore.Delete(ctx, key)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+
+	return err
+}
+
+// uniqueSvec returns an array containing the unique elements of the
+// given array.
+func uniqueSvec(vec []string) []string {
+
+	mp := make(map[string]bool)
+	for _, x := range vec {
+		mp[x] = true
+	}
+
+	uvec := make([]string, len(mp))
+	i := 0
+	for k := range mp {
+		uvec[i] = k
+		i++
+	}
+
+	return uvec
+}
+
+// sdiff returns the given vector with the elements in rm removed.
+func sdiff(vec []string, rm map[string]bool) []string {
+
+	dvec := make([]string, 0, len(vec))
+	for _, v := range vec {
+		_, ok := rm[v]
+		if !ok {
+			dvec = append(dvec, v)
+		}
+	}
+	return dvec
+}
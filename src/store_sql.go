@@ -0,0 +1,214 @@
+package randomization
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// sqlSchema creates the tables used by sqlRepository.  The projects
+// are stored in decoded form as JSON documents, see projectJSON,
+// together with their owners and creation times so that the projects
+// of a user can be listed.  Each row of the
+// sharing table shares one project with one user, whose name is also
+// stored in lower case as user_key.
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS projects (
+		pkey VARCHAR(500) NOT NULL PRIMARY KEY,
+		owner VARCHAR(250) NOT NULL,
+		created BIGINT NOT NULL,
+		project TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS sharing (
+		pkey VARCHAR(500) NOT NULL,
+		user_name VARCHAR(250) NOT NULL,
+		user_key VARCHAR(250) NOT NULL,
+		PRIMARY KEY (pkey, user_key))`,
+}
+
+// sqlRepository stores the projects in a SQL database, such as an
+// embedded SQLite database.  The queries use "?" placeholders and the
+// "INSERT ... ON CONFLICT ... DO UPDATE" upsert of SQLite (version
+// 3.24 or later).
+type sqlRepository struct {
+	db *sql.DB
+}
+
+// NewSQLRepository returns a repository that stores the projects in
+// the given database, creating its tables if they do not exist.  The
+// database driver is registered by the program that opens db, which
+// passes the repository to SetRepository.  Only the storage is
+// replaced: the handlers still obtain their context from
+// appengine.NewContext and the user from user.Current, so the App
+// Engine request and login services are still required.
+func NewSQLRepository(db *sql.DB) (Repository, error) {
+
+	for _, s := range sqlSchema {
+		if _, err := db.Exec(s); err != nil {
+			return nil, err
+		}
+	}
+
+	return &sqlRepository{db: db}, nil
+}
+
+// projectJSON returns the stored project in JSON format.  The project
+// is decoded first, so that its fields are stored as JSON rather than
+// as the base64 encoding of the JSON byte slices of EncodedProject.
+func projectJSON(eproj *EncodedProject) (string, error) {
+
+	proj, err := decodeProject(eproj)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(proj)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// projectFromJSON converts a project stored by projectJSON back to an
+// EncodedProject.
+func projectFromJSON(b string) (*EncodedProject, error) {
+
+	proj := new(Project)
+	if err := json.Unmarshal([]byte(b), proj); err != nil {
+		return nil, err
+	}
+
+	return encodeProject(proj)
+}
+
+func (r *sqlRepository) GetProject(ctx context.Context, pkey string) (*EncodedProject, error) {
+
+	var b string
+	err := r.db.QueryRowContext(ctx, "SELECT project FROM projects WHERE pkey = ?", pkey).Scan(&b)
+	if err == sql.ErrNoRows {
+		return nil, ErrNoSuchProject
+	} else if err != nil {
+		return nil, err
+	}
+
+	return projectFromJSON(b)
+}
+
+func (r *sqlRepository) PutProject(ctx context.Context, pkey string, eproj *EncodedProject) error {
+
+	b, err := projectJSON(eproj)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.db.ExecContext(ctx, `INSERT INTO projects (pkey, owner, created, project) VALUES (?, ?, ?, ?)
+		ON CONFLICT (pkey) DO UPDATE SET owner = excluded.owner, created = excluded.created, project = excluded.project`,
+		pkey, eproj.Owner, eproj.Created.UnixNano(), b)
+
+	return err
+}
+
+func (r *sqlRepository) DeleteProject(ctx context.Context, pkey string) error {
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM projects WHERE pkey = ?", pkey)
+
+	return err
+}
+
+func (r *sqlRepository) GetProjects(ctx context.Context, owner string, limit int) ([]string, []*EncodedProject, error) {
+
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT pkey, project FROM projects WHERE owner = ? ORDER BY created DESC LIMIT ?", owner, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var keylist []string
+	var projlist []*EncodedProject
+	for rows.Next() {
+		var pkey, b string
+		if err := rows.Scan(&pkey, &b); err != nil {
+			return nil, nil, err
+		}
+		eproj, err := projectFromJSON(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		keylist = append(keylist, pkey)
+		projlist = append(projlist, eproj)
+	}
+
+	return keylist, projlist, rows.Err()
+}
+
+// queryStrings returns the values of the single column selected by
+// the query.
+func (r *sqlRepository) queryStrings(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vals := []string{}
+	for rows.Next() {
+		var x string
+		if err := rows.Scan(&x); err != nil {
+			return nil, err
+		}
+		vals = append(vals, x)
+	}
+
+	return vals, rows.Err()
+}
+
+func (r *sqlRepository) GetSharedUsers(ctx context.Context, pkey string) ([]string, error) {
+
+	return r.queryStrings(ctx, "SELECT user_name FROM sharing WHERE pkey = ? ORDER BY user_key", pkey)
+}
+
+func (r *sqlRepository) GetSharedProjects(ctx context.Context, userName string) ([]string, error) {
+
+	return r.queryStrings(ctx, "SELECT pkey FROM sharing WHERE user_key = ? ORDER BY pkey", strings.ToLower(userName))
+}
+
+func (r *sqlRepository) AddSharing(ctx context.Context, pkey string, userNames []string) error {
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, u := range userNames {
+		_, err := tx.ExecContext(ctx, `INSERT INTO sharing (pkey, user_name, user_key) VALUES (?, ?, ?)
+			ON CONFLICT (pkey, user_key) DO UPDATE SET user_name = excluded.user_name`, pkey, u, strings.ToLower(u))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *sqlRepository) RemoveSharing(ctx context.Context, pkey string, userNames []string) error {
+
+	for _, u := range userNames {
+		_, err := r.db.ExecContext(ctx, "DELETE FROM sharing WHERE pkey = ? AND user_key = ?", pkey, strings.ToLower(u))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *sqlRepository) DeleteSharing(ctx context.Context, pkey string) error {
+
+	_, err := r.db.ExecContext(ctx, "DELETE FROM sharing WHERE pkey = ?", pkey)
+
+	return err
+}
@@ -0,0 +1,167 @@
+package randomization
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestSQLRepository returns a repository backed by an in-memory
+// SQLite database.  The database only exists while its connection is
+// open, so the pool is limited to a single connection.
+func newTestSQLRepository(t *testing.T) Repository {
+
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	repo, err := NewSQLRepository(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return repo
+}
+
+func sqlTestProject(owner, name string, created time.Time) *Project {
+
+	proj := &Project{
+		Owner:        owner,
+		Created:      created,
+		Name:         name,
+		GroupNames:   []string{"A", "B"},
+		Variables:    []Variable{{Name: "Sex", Levels: []string{"F", "M"}, Weight: 1, Func: "Range", Type: "Categorical"}},
+		Assignments:  []int{0, 0},
+		Bias:         5,
+		StoreRawData: true,
+		Open:         true,
+		Method:       "Minimization",
+	}
+	proj.Data = newAggregateData(proj)
+
+	return proj
+}
+
+func TestSQLRepositoryProjects(t *testing.T) {
+
+	ctx := context.Background()
+	repo := newTestSQLRepository(t)
+
+	t0 := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	p1 := sqlTestProject("alice", "first", t0)
+	p2 := sqlTestProject("alice", "second", t0.Add(time.Hour))
+	p3 := sqlTestProject("bob", "other", t0)
+
+	for _, p := range []*Project{p1, p2, p3} {
+		ep, err := encodeProject(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.PutProject(ctx, p.Owner+"::"+p.Name, ep); err != nil {
+			t.Fatalf("PutProject: %v", err)
+		}
+	}
+
+	// Store an assignment, replacing the stored project.
+	p1.Assignments[1]++
+	p1.NumAssignments++
+	p1.Data[0][0][1]++
+	ep, err := encodeProject(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PutProject(ctx, "alice::first", ep); err != nil {
+		t.Fatalf("PutProject: %v", err)
+	}
+
+	ep, err = repo.GetProject(ctx, "alice::first")
+	if err != nil {
+		t.Fatalf("GetProject: %v", err)
+	}
+	proj, err := decodeProject(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proj.Owner != "alice" || proj.Name != "first" || !proj.Created.Equal(t0) || proj.Method != "Minimization" {
+		t.Errorf("GetProject: got owner %q, name %q, created %v, method %q", proj.Owner, proj.Name, proj.Created, proj.Method)
+	}
+	if !reflect.DeepEqual(proj.GroupNames, p1.GroupNames) || !reflect.DeepEqual(proj.Variables, p1.Variables) {
+		t.Errorf("GetProject: got groups %v, variables %v", proj.GroupNames, proj.Variables)
+	}
+	if !reflect.DeepEqual(proj.Assignments, []int{0, 1}) || proj.NumAssignments != 1 || !reflect.DeepEqual(proj.Data, p1.Data) {
+		t.Errorf("GetProject: the update was not stored, got assignments %v, data %v", proj.Assignments, proj.Data)
+	}
+
+	keys, projs, err := repo.GetProjects(ctx, "alice", maxProjectsPerUser)
+	if err != nil {
+		t.Fatalf("GetProjects: %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"alice::second", "alice::first"}) || len(projs) != 2 || projs[0].Name != "second" {
+		t.Errorf("GetProjects: got %v", keys)
+	}
+	if keys, _, _ = repo.GetProjects(ctx, "alice", 1); len(keys) != 1 {
+		t.Errorf("GetProjects: got %d projects with limit 1", len(keys))
+	}
+
+	if err := repo.DeleteProject(ctx, "alice::first"); err != nil {
+		t.Fatalf("DeleteProject: %v", err)
+	}
+	if _, err := repo.GetProject(ctx, "alice::first"); err != ErrNoSuchProject {
+		t.Errorf("GetProject after DeleteProject: got %v, want ErrNoSuchProject", err)
+	}
+}
+
+func TestSQLRepositorySharing(t *testing.T) {
+
+	ctx := context.Background()
+	repo := newTestSQLRepository(t)
+
+	if err := repo.AddSharing(ctx, "alice::first", []string{"Bob", "carol"}); err != nil {
+		t.Fatalf("AddSharing: %v", err)
+	}
+	if err := repo.AddSharing(ctx, "alice::second", []string{"bob"}); err != nil {
+		t.Fatalf("AddSharing: %v", err)
+	}
+
+	users, err := repo.GetSharedUsers(ctx, "alice::first")
+	if err != nil {
+		t.Fatalf("GetSharedUsers: %v", err)
+	}
+	if !reflect.DeepEqual(users, []string{"Bob", "carol"}) {
+		t.Errorf("GetSharedUsers: got %v", users)
+	}
+
+	// The user names are compared without regard to case.
+	pkeys, err := repo.GetSharedProjects(ctx, "BOB")
+	if err != nil {
+		t.Fatalf("GetSharedProjects: %v", err)
+	}
+	if !reflect.DeepEqual(pkeys, []string{"alice::first", "alice::second"}) {
+		t.Errorf("GetSharedProjects: got %v", pkeys)
+	}
+
+	if err := repo.RemoveSharing(ctx, "alice::first", []string{"bob"}); err != nil {
+		t.Fatalf("RemoveSharing: %v", err)
+	}
+	if users, _ = repo.GetSharedUsers(ctx, "alice::first"); !reflect.DeepEqual(users, []string{"carol"}) {
+		t.Errorf("GetSharedUsers after RemoveSharing: got %v", users)
+	}
+
+	if err := repo.DeleteSharing(ctx, "alice::first"); err != nil {
+		t.Fatalf("DeleteSharing: %v", err)
+	}
+	if users, _ = repo.GetSharedUsers(ctx, "alice::first"); len(users) != 0 {
+		t.Errorf("GetSharedUsers after DeleteSharing: got %v", users)
+	}
+	if pkeys, _ = repo.GetSharedProjects(ctx, "bob"); !reflect.DeepEqual(pkeys, []string{"alice::second"}) {
+		t.Errorf("GetSharedProjects after DeleteSharing: got %v", pkeys)
+	}
+}
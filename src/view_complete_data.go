@@ -37,13 +37,51 @@ func viewCompleteData(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 
-	// Header line
+	// Header line.  The columns that depend on the project's design
+	// follow the variables, so that the leading columns are the same
+	// for all projects.
 	_, _ = io.WriteString(w, "Subject id,Assignment date,Assignment time,")
 	_, _ = io.WriteString(w, "Assigned group,Final group,Included,Assigner")
 	for _, va := range proj.Variables {
 		_, _ = io.WriteString(w, ",")
 		_, _ = io.WriteString(w, va.Name)
 	}
+	for _, fa := range proj.Factors {
+		_, _ = io.WriteString(w, ","+fa.Name)
+	}
+	if len(proj.Sites) > 0 {
+		_, _ = io.WriteString(w, ",Site")
+	}
+	_, _ = io.WriteString(w, ",Seed")
+	if len(proj.Batches) > 0 {
+		_, _ = io.WriteString(w, ",Batch")
+	}
+
+	// The allocation probabilities are included if they were
+	// recorded for any subject.
+	anyProbs := false
+	for _, rec := range proj.RawData {
+		if rec.Probs != nil {
+			anyProbs = true
+		}
+	}
+	if anyProbs {
+		for _, g := range proj.GroupNames {
+			_, _ = io.WriteString(w, ",P("+g+")")
+		}
+	}
+	if proj.OutcomeType != "" {
+		_, _ = io.WriteString(w, ",Outcome")
+	}
+	for _, st := range proj.Stages {
+		_, _ = io.WriteString(w, ","+st.Name+" group")
+		for _, va := range st.Variables[1:] {
+			_, _ = io.WriteString(w, ","+st.Name+" "+va.Name)
+		}
+		for _, g := range st.GroupNames {
+			_, _ = io.WriteString(w, ","+st.Name+" P("+g+")")
+		}
+	}
 	_, _ = io.WriteString(w, "\n")
 
 	for _, rec := range proj.RawData {
@@ -65,8 +103,57 @@ func viewCompleteData(w http.ResponseWriter, r *http.Request) {
 		} else {
 			_, _ = io.WriteString(w, "No,")
 		}
-		_, _ = io.WriteString(w, rec.Assigner+",")
-		_, _ = io.WriteString(w, strings.Join(rec.Data, ","))
+		_, _ = io.WriteString(w, rec.Assigner)
+		for _, x := range rec.Data {
+			_, _ = io.WriteString(w, ","+x)
+		}
+		for _, x := range groupFactorLevels(proj, rec.CurrentGroup) {
+			_, _ = io.WriteString(w, ","+x)
+		}
+		if len(proj.Sites) > 0 {
+			_, _ = io.WriteString(w, ","+rec.Site)
+		}
+		_, _ = io.WriteString(w, ",")
+		if rec.Seed != 0 {
+			_, _ = io.WriteString(w, fmt.Sprintf("%d", rec.Seed))
+		}
+		if len(proj.Batches) > 0 {
+			_, _ = io.WriteString(w, ",")
+			if rec.Batch > 0 {
+				_, _ = io.WriteString(w, fmt.Sprintf("%d", rec.Batch))
+			}
+		}
+		if anyProbs {
+			for i := range proj.GroupNames {
+				_, _ = io.WriteString(w, ",")
+				switch {
+				case i < len(rec.Probs):
+					_, _ = io.WriteString(w, fmt.Sprintf("%g", rec.Probs[i]))
+				case rec.Batch > 0:
+					// The probabilities of a joint
+					// assignment are not available.
+					_, _ = io.WriteString(w, "NA")
+				}
+			}
+		}
+		if proj.OutcomeType != "" {
+			_, _ = io.WriteString(w, ",")
+			if rec.HasOutcome {
+				_, _ = io.WriteString(w, fmt.Sprintf("%g", rec.Outcome))
+			}
+		}
+		for s, st := range proj.Stages {
+			values := make([]string, len(st.Variables)+len(st.GroupNames))
+			if s < len(rec.StageAssignments) {
+				sa := rec.StageAssignments[s]
+				values[0] = sa.Group
+				copy(values[1:], sa.Data[1:])
+				for i, p := range sa.Probs {
+					values[len(st.Variables)+i] = fmt.Sprintf("%g", p)
+				}
+			}
+			_, _ = io.WriteString(w, ","+strings.Join(values, ","))
+		}
 		_, _ = io.WriteString(w, "\n")
 	}
 }
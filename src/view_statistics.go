@@ -2,7 +2,11 @@ package randomization
 
 import (
 	"fmt"
+	"html/template"
+	"math"
 	"net/http"
+	"sort"
+	"strings"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
@@ -52,20 +56,95 @@ func viewStatistics(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Balance statistics
-	balStat := make([][]string, m)
-	jj := 0
+	balStat := levelStats(project, data, project.Assignments, "")
+
+	// Enrollment and imbalance over time
+	var charts []template.HTML
+	var history *EnrollmentHistory
+	if project.StoreRawData {
+		history = enrollmentHistory(project)
+		charts = enrollmentCharts(project, history)
+	}
+
+	// Formal balance diagnostics
+	diags := balanceDiagnostics(project)
+
+	// Means and standard deviations of the continuous variables
+	var contStat [][]string
 	for j, v := range project.Variables {
-		numLevels := len(v.Levels)
-		for k := 0; k < numLevels; k++ {
-			fstat := make([]string, 1+numGroups)
-			fstat[0] = v.Name + "=" + v.Levels[k]
-			for q := 0; q < numGroups; q++ {
-				u := data[j][k][q]
-				fstat[q+1] = fmt.Sprintf("%.0f", u)
+		if v.Type != "Continuous" {
+			continue
+		}
+		means, sds, _, _ := groupMoments(data[j])
+		fstat := make([]string, 1+numGroups)
+		fstat[0] = v.Name
+		for q := 0; q < numGroups; q++ {
+			if math.IsNaN(means[q]) {
+				fstat[q+1] = "-"
+			} else {
+				fstat[q+1] = fmt.Sprintf("%.2f (%.2f)", means[q], sds[q])
 			}
-			balStat[jj] = fstat
-			jj++
 		}
+		contStat = append(contStat, fstat)
+	}
+
+	// Statistics within strata
+	var strata []string
+	for k := range project.StratumAssignments {
+		strata = append(strata, k)
+	}
+	sort.Strings(strata)
+	stratStat := make([][]string, len(strata))
+	for i, k := range strata {
+		values := cleanSplit(k, ",")
+		labels := make([]string, len(values))
+		for j, x := range values {
+			labels[j] = project.Variables[j].Name + "=" + x
+		}
+		fstat := make([]string, 1+numGroups)
+		fstat[0] = strings.Join(labels, ", ")
+		for q, n := range project.StratumAssignments[k] {
+			fstat[q+1] = fmt.Sprintf("%d", n)
+		}
+		stratStat[i] = fstat
+	}
+
+	// Outcomes of response-adaptive allocation
+	var outcomeStat [][]string
+	if project.OutcomeStats != nil {
+		means, sds, _, _ := groupMoments(project.OutcomeStats)
+		nrow := make([]string, 1+numGroups)
+		mrow := make([]string, 1+numGroups)
+		nrow[0] = "Number of outcomes"
+		mrow[0] = "Mean (standard deviation)"
+		if project.OutcomeType == "Binary" {
+			mrow[0] = "Proportion of ones"
+		}
+		for q := 0; q < numGroups; q++ {
+			nrow[q+1] = fmt.Sprintf("%.0f", project.OutcomeStats[0][q])
+			switch {
+			case math.IsNaN(means[q]):
+				mrow[q+1] = "-"
+			case project.OutcomeType == "Binary":
+				mrow[q+1] = fmt.Sprintf("%.2f", means[q])
+			default:
+				mrow[q+1] = fmt.Sprintf("%.2f (%.2f)", means[q], sds[q])
+			}
+		}
+		outcomeStat = [][]string{nrow, mrow}
+	}
+
+	// Statistics within sites
+	var siteAsgn, siteStat [][]string
+	for _, site := range project.Sites {
+		sdata, sasgn := siteAggregates(project, site)
+		fstat := make([]string, 1+numGroups)
+		fstat[0] = site
+		for q, n := range sasgn {
+			fstat[q+1] = fmt.Sprintf("%d", n)
+		}
+		siteAsgn = append(siteAsgn, fstat)
+		siteStat = append(siteStat, levelStats(project, sdata, sasgn, site+": ")...)
 	}
 
 	tvals := struct {
@@ -76,19 +155,88 @@ func viewStatistics(w http.ResponseWriter, r *http.Request) {
 		ProjectView *ProjectView
 		TxAsgn      [][]string
 		BalStat     [][]string
+		AnyCont     bool
+		ContStat    [][]string
+		AnyStrata   bool
+		StratStat   [][]string
+		OutcomeStat [][]string
+		AnySites    bool
+		SiteAsgn    [][]string
+		SiteStat    [][]string
+		FactorStat  []*FactorStat
+		StageStat   []*StageStat
+		PredStat    [][]string
+		BalDiag     [][]string
+		BalLevels   [][]string
+		Charts      []template.HTML
+		History     *EnrollmentHistory
+		Warning     string
 		Pkey        string
 	}{
 		User:        user.String(),
 		LoggedIn:    user != nil,
 		Project:     project,
-		AnyVars:     len(project.Variables) > 0,
+		AnyVars:     m > 0,
 		ProjectView: projectView,
 		TxAsgn:      txAsgn,
 		Pkey:        pkey,
 		BalStat:     balStat,
+		AnyCont:     len(contStat) > 0,
+		ContStat:    contStat,
+		AnyStrata:   len(project.Variables) > 0 && len(strata) > 0,
+		StratStat:   stratStat,
+		OutcomeStat: outcomeStat,
+		AnySites:    len(project.Sites) > 0,
+		SiteAsgn:    siteAsgn,
+		SiteStat:    siteStat,
+		FactorStat:  factorStats(project),
+		StageStat:   stageStats(project),
+		PredStat:    predictabilityStats(project),
+		BalDiag:     diagnosticSummary(diags),
+		BalLevels:   diagnosticLevels(diags),
+		Charts:      charts,
+		History:     history,
+		Warning:     strataWarning(project),
 	}
 
 	if err := tmpl.ExecuteTemplate(w, "view_statistics.html", tvals); err != nil {
 		log.Errorf(ctx, "viewStatistics failed to execute template: %v", err)
 	}
 }
+
+// levelStats returns the number of subjects in each treatment group
+// within each level of the categorical variables, using the given
+// aggregate data and group sizes.  Variables that allow missing values
+// have an additional row for the subjects whose value is missing.  The
+// row labels start with prefix.
+func levelStats(project *Project, data [][][]float64, assignments []int, prefix string) [][]string {
+
+	numGroups := len(project.GroupNames)
+
+	var stats [][]string
+	for j, v := range project.Variables {
+		missing := make([]float64, numGroups)
+		for q := range missing {
+			missing[q] = float64(assignments[q])
+		}
+		for k, level := range v.Levels {
+			fstat := make([]string, 1+numGroups)
+			fstat[0] = prefix + v.Name + "=" + level
+			for q := 0; q < numGroups; q++ {
+				fstat[q+1] = fmt.Sprintf("%.0f", data[j][k][q])
+				missing[q] -= data[j][k][q]
+			}
+			stats = append(stats, fstat)
+		}
+		if v.AllowMissing && v.Type != "Continuous" {
+			fstat := make([]string, 1+numGroups)
+			fstat[0] = prefix + v.Name + " missing"
+			for q := 0; q < numGroups; q++ {
+				fstat[q+1] = fmt.Sprintf("%.0f", missing[q])
+			}
+			stats = append(stats, fstat)
+		}
+	}
+
+	return stats
+}